@@ -1,11 +1,13 @@
 package main
 
 import (
-    "os"
+    "context"
     "os/signal"
     "syscall"
+    "time"
 
     "github.com/sirupsen/logrus"
+    "k8s.io/client-go/dynamic"
     "k8s.io/client-go/kubernetes"
     "k8s.io/client-go/rest"
     "helm-monitor/pkg/helm"
@@ -26,28 +28,38 @@ func main() {
     if err != nil {
         log.Fatalf("Failed to create Kubernetes client: %v", err)
     }
+    dynamicClient, err := dynamic.NewForConfig(config)
+    if err != nil {
+        log.Fatalf("Failed to create Kubernetes dynamic client: %v", err)
+    }
     log.Debug("Kubernetes client initialized successfully")
 
     // Initialize Helm monitor
     log.Debug("Initializing Helm monitor")
-    monitor := helm.NewMonitor(clientset, log)
+    monitor := helm.NewMonitor(clientset, dynamicClient, log)
     log.Debug("Helm monitor initialized successfully")
 
-    // Get check interval from environment
-    intervalStr := os.Getenv("CHECK_INTERVAL")
-    if intervalStr == "" {
-        intervalStr = "6h"
-    }
-    log.Debugf("Starting monitoring loop with interval: %s", intervalStr)
-
     // Set up signal handling
-    sigChan := make(chan os.Signal, 1)
-    signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+    defer stop()
+
+    // Every replica serves the API and metrics
+    go func() {
+        if err := monitor.Serve(ctx); err != nil {
+            log.Errorf("HTTP server stopped: %v", err)
+        }
+    }()
 
-    // Start the monitor
-    go monitor.Start()
+    // Start the monitor, only on the leader when leader election is enabled
+    go func() {
+        if err := monitor.Run(ctx); err != nil {
+            log.Fatalf("Failed to run monitor: %v", err)
+        }
+    }()
 
     // Wait for shutdown signal
-    <-sigChan
+    <-ctx.Done()
     log.Info("Received shutdown signal, exiting...")
-}
\ No newline at end of file
+    // Give leader election a moment to release the Lease
+    time.Sleep(time.Second)
+}
@@ -0,0 +1,279 @@
+package helm
+
+import (
+    "fmt"
+    "sort"
+    "strings"
+    "github.com/Masterminds/semver/v3"
+    "gopkg.in/yaml.v2"
+    "helm.sh/helm/v3/pkg/action"
+    "helm.sh/helm/v3/pkg/chart"
+    "helm.sh/helm/v3/pkg/chartutil"
+    "helm.sh/helm/v3/pkg/release"
+    "helm.sh/helm/v3/pkg/releaseutil"
+)
+
+type deprecatedAPI struct {
+    deprecatedIn string
+    removedIn    string
+    replacement  string
+}
+
+// deprecatedAPIs lists API versions deprecated or removed in Kubernetes, keyed by
+// "apiVersion/Kind", following the Kubernetes deprecated API migration guide.
+var deprecatedAPIs = map[string]deprecatedAPI{
+    "extensions/v1beta1/Deployment":        {"1.9", "1.16", "apps/v1"},
+    "extensions/v1beta1/DaemonSet":         {"1.9", "1.16", "apps/v1"},
+    "extensions/v1beta1/ReplicaSet":        {"1.9", "1.16", "apps/v1"},
+    "extensions/v1beta1/NetworkPolicy":     {"1.9", "1.16", "networking.k8s.io/v1"},
+    "extensions/v1beta1/PodSecurityPolicy": {"1.10", "1.16", "policy/v1beta1"},
+    "extensions/v1beta1/Ingress":           {"1.14", "1.22", "networking.k8s.io/v1"},
+    "apps/v1beta1/Deployment":              {"1.9", "1.16", "apps/v1"},
+    "apps/v1beta1/StatefulSet":             {"1.9", "1.16", "apps/v1"},
+    "apps/v1beta2/Deployment":              {"1.9", "1.16", "apps/v1"},
+    "apps/v1beta2/StatefulSet":             {"1.9", "1.16", "apps/v1"},
+    "apps/v1beta2/DaemonSet":               {"1.9", "1.16", "apps/v1"},
+    "apps/v1beta2/ReplicaSet":              {"1.9", "1.16", "apps/v1"},
+
+    "networking.k8s.io/v1beta1/Ingress":                                  {"1.19", "1.22", "networking.k8s.io/v1"},
+    "networking.k8s.io/v1beta1/IngressClass":                             {"1.19", "1.22", "networking.k8s.io/v1"},
+    "rbac.authorization.k8s.io/v1beta1/ClusterRole":                      {"1.17", "1.22", "rbac.authorization.k8s.io/v1"},
+    "rbac.authorization.k8s.io/v1beta1/ClusterRoleBinding":               {"1.17", "1.22", "rbac.authorization.k8s.io/v1"},
+    "rbac.authorization.k8s.io/v1beta1/Role":                             {"1.17", "1.22", "rbac.authorization.k8s.io/v1"},
+    "rbac.authorization.k8s.io/v1beta1/RoleBinding":                      {"1.17", "1.22", "rbac.authorization.k8s.io/v1"},
+    "apiextensions.k8s.io/v1beta1/CustomResourceDefinition":              {"1.16", "1.22", "apiextensions.k8s.io/v1"},
+    "admissionregistration.k8s.io/v1beta1/MutatingWebhookConfiguration":  {"1.16", "1.22", "admissionregistration.k8s.io/v1"},
+    "admissionregistration.k8s.io/v1beta1/ValidatingWebhookConfiguration": {"1.16", "1.22", "admissionregistration.k8s.io/v1"},
+    "apiregistration.k8s.io/v1beta1/APIService":                          {"1.19", "1.22", "apiregistration.k8s.io/v1"},
+    "scheduling.k8s.io/v1beta1/PriorityClass":                            {"1.14", "1.22", "scheduling.k8s.io/v1"},
+    "storage.k8s.io/v1beta1/CSIDriver":                                   {"1.19", "1.22", "storage.k8s.io/v1"},
+    "storage.k8s.io/v1beta1/CSINode":                                     {"1.17", "1.22", "storage.k8s.io/v1"},
+    "storage.k8s.io/v1beta1/StorageClass":                                {"1.19", "1.22", "storage.k8s.io/v1"},
+    "storage.k8s.io/v1beta1/VolumeAttachment":                            {"1.19", "1.22", "storage.k8s.io/v1"},
+    "coordination.k8s.io/v1beta1/Lease":                                  {"1.19", "1.22", "coordination.k8s.io/v1"},
+    "certificates.k8s.io/v1beta1/CertificateSigningRequest":              {"1.19", "1.22", "certificates.k8s.io/v1"},
+
+    "batch/v1beta1/CronJob":                       {"1.21", "1.25", "batch/v1"},
+    "discovery.k8s.io/v1beta1/EndpointSlice":      {"1.21", "1.25", "discovery.k8s.io/v1"},
+    "events.k8s.io/v1beta1/Event":                 {"1.19", "1.25", "events.k8s.io/v1"},
+    "autoscaling/v2beta1/HorizontalPodAutoscaler": {"1.22", "1.25", "autoscaling/v2"},
+    "policy/v1beta1/PodDisruptionBudget":          {"1.21", "1.25", "policy/v1"},
+    "policy/v1beta1/PodSecurityPolicy":            {"1.21", "1.25", "Pod Security Admission"},
+    "node.k8s.io/v1beta1/RuntimeClass":            {"1.20", "1.25", "node.k8s.io/v1"},
+
+    "autoscaling/v2beta2/HorizontalPodAutoscaler":                    {"1.23", "1.26", "autoscaling/v2"},
+    "flowcontrol.apiserver.k8s.io/v1beta1/FlowSchema":                {"1.23", "1.26", "flowcontrol.apiserver.k8s.io/v1beta3"},
+    "flowcontrol.apiserver.k8s.io/v1beta1/PriorityLevelConfiguration": {"1.23", "1.26", "flowcontrol.apiserver.k8s.io/v1beta3"},
+    "storage.k8s.io/v1beta1/CSIStorageCapacity":                      {"1.24", "1.27", "storage.k8s.io/v1"},
+    "flowcontrol.apiserver.k8s.io/v1beta2/FlowSchema":                {"1.26", "1.29", "flowcontrol.apiserver.k8s.io/v1"},
+    "flowcontrol.apiserver.k8s.io/v1beta2/PriorityLevelConfiguration": {"1.26", "1.29", "flowcontrol.apiserver.k8s.io/v1"},
+    "flowcontrol.apiserver.k8s.io/v1beta3/FlowSchema":                {"1.29", "1.32", "flowcontrol.apiserver.k8s.io/v1"},
+    "flowcontrol.apiserver.k8s.io/v1beta3/PriorityLevelConfiguration": {"1.29", "1.32", "flowcontrol.apiserver.k8s.io/v1"},
+}
+
+type manifestResource struct {
+    APIVersion string `yaml:"apiVersion"`
+    Kind       string `yaml:"kind"`
+    Metadata   struct {
+        Name string `yaml:"name"`
+    } `yaml:"metadata"`
+}
+
+type APIFinding struct {
+    APIVersion  string
+    Kind        string
+    Name        string
+    KubeVersion string // version the finding applies to
+    Removed     bool   // false means deprecated only
+    API         deprecatedAPI
+}
+
+func parseManifestResources(manifest string) []manifestResource {
+    var resources []manifestResource
+    for _, doc := range releaseutil.SplitManifests(manifest) {
+        var res manifestResource
+        if err := yaml.Unmarshal([]byte(doc), &res); err != nil || res.Kind == "" {
+            continue
+        }
+        resources = append(resources, res)
+    }
+
+    sort.Slice(resources, func(i, j int) bool {
+        if resources[i].Kind != resources[j].Kind {
+            return resources[i].Kind < resources[j].Kind
+        }
+        return resources[i].Metadata.Name < resources[j].Metadata.Name
+    })
+    return resources
+}
+
+// minorVersionReached reports whether kubeVersion is at or past the given
+// "major.minor" release, ignoring patch and vendor suffixes like "-eks".
+func minorVersionReached(kubeVersion, minor string) bool {
+    kv, err := semver.NewVersion(kubeVersion)
+    if err != nil {
+        return false
+    }
+    rv, err := semver.NewVersion(minor)
+    if err != nil {
+        return false
+    }
+    if kv.Major() != rv.Major() {
+        return kv.Major() > rv.Major()
+    }
+    return kv.Minor() >= rv.Minor()
+}
+
+func findDeprecatedAPIs(manifest, kubeVersion string) []APIFinding {
+    var findings []APIFinding
+    for _, res := range parseManifestResources(manifest) {
+        api, ok := deprecatedAPIs[res.APIVersion+"/"+res.Kind]
+        if !ok || !minorVersionReached(kubeVersion, api.deprecatedIn) {
+            continue
+        }
+        findings = append(findings, APIFinding{
+            APIVersion:  res.APIVersion,
+            Kind:        res.Kind,
+            Name:        res.Metadata.Name,
+            KubeVersion: kubeVersion,
+            Removed:     minorVersionReached(kubeVersion, api.removedIn),
+            API:         api,
+        })
+    }
+    return findings
+}
+
+// renderChart renders the chart client-side with the given values, the same
+// way helm template does, and returns the resulting manifest.
+func renderChart(chrt *chart.Chart, releaseName, namespace string, values map[string]interface{}, kubeVersion string) (string, error) {
+    install := action.NewInstall(&action.Configuration{})
+    install.DryRun = true
+    install.ClientOnly = true
+    install.Replace = true
+    install.ReleaseName = releaseName
+    install.Namespace = namespace
+
+    if kubeVersion != "" {
+        kv, err := chartutil.ParseKubeVersion(kubeVersion)
+        if err != nil {
+            return "", fmt.Errorf("invalid Kubernetes version %s: %v", kubeVersion, err)
+        }
+        install.KubeVersion = kv
+    }
+
+    rel, err := install.Run(chrt, values)
+    if err != nil {
+        return "", fmt.Errorf("failed to render chart: %v", err)
+    }
+    return rel.Manifest, nil
+}
+
+// usesAPI reports whether any resource in the manifest still uses the
+// apiVersion and kind of the finding.
+func usesAPI(manifest string, finding APIFinding) bool {
+    for _, res := range parseManifestResources(manifest) {
+        if res.APIVersion == finding.APIVersion && res.Kind == finding.Kind {
+            return true
+        }
+    }
+    return false
+}
+
+func formatAPIFinding(finding APIFinding) string {
+    state := fmt.Sprintf("deprecated in %s, removed in %s", finding.API.deprecatedIn, finding.API.removedIn)
+    if finding.Removed {
+        state = fmt.Sprintf("removed in %s", finding.API.removedIn)
+    }
+    return fmt.Sprintf("      *%s %s* (%s): %s on %s, use %s\n",
+        finding.Kind, finding.Name, finding.APIVersion, state, finding.KubeVersion, finding.API.replacement)
+}
+
+func formatAPIReport(releaseName, namespace string, findings []APIFinding, fixedBy string) string {
+    msg := fmt.Sprintf("•    *release*: %s\n      *namespace*: %s\n", releaseName, namespace)
+    for _, finding := range findings {
+        msg += formatAPIFinding(finding)
+    }
+    if fixedBy != "" {
+        msg += fmt.Sprintf("      *fixed by latest chart*: %s\n", fixedBy)
+    }
+    return msg
+}
+
+func apiFindingKinds(findings []APIFinding) string {
+    var kinds []string
+    for _, finding := range findings {
+        kinds = append(kinds, fmt.Sprintf("%s/%s %s", finding.APIVersion, finding.Kind, finding.Name))
+    }
+    return strings.Join(kinds, ", ")
+}
+
+// checkDeprecatedAPIs finds resources in the installed manifest of the
+// release that use APIs deprecated or removed in the cluster version or the
+// target version. It returns them with the version they were checked against.
+// The installed manifest does not need the chart repository, so releases
+// whose latest version cannot be looked up are checked too.
+func (m *Monitor) checkDeprecatedAPIs(rel *release.Release, kubeVersion, targetVersion string) ([]APIFinding, string) {
+    checkVersion := kubeVersion
+    if targetVersion != "" {
+        checkVersion = targetVersion
+    }
+    if checkVersion == "" {
+        return nil, ""
+    }
+
+    findings := findDeprecatedAPIs(rel.Manifest, checkVersion)
+    if targetVersion != "" && kubeVersion != "" {
+        // Resources already deprecated on the running cluster are covered by
+        // the target version findings, which are at least as severe.
+        seen := make(map[string]bool)
+        for _, finding := range findings {
+            seen[finding.APIVersion+"/"+finding.Kind+"/"+finding.Name] = true
+        }
+        for _, finding := range findDeprecatedAPIs(rel.Manifest, kubeVersion) {
+            if !seen[finding.APIVersion+"/"+finding.Kind+"/"+finding.Name] {
+                findings = append(findings, finding)
+            }
+        }
+    }
+    if len(findings) > 0 {
+        m.log.Warnf("Helm release %s in namespace: %s uses deprecated Kubernetes APIs: %s",
+            rel.Name, rel.Namespace, apiFindingKinds(findings))
+    }
+    return findings, checkVersion
+}
+
+// apisFixedBy reports whether rendering the latest chart with the release's
+// values fixes the deprecated APIs.
+func (m *Monitor) apisFixedBy(rel *release.Release, latestVersion string, hasUpdate bool,
+    latestChart func() (*chart.Chart, error), findings []APIFinding, checkVersion string) string {
+    if !hasUpdate {
+        return fmt.Sprintf("no, %s is already the latest version", latestVersion)
+    }
+    return m.latestChartFixesAPIs(rel, latestVersion, latestChart, findings, checkVersion)
+}
+
+func (m *Monitor) latestChartFixesAPIs(rel *release.Release, latestVersion string,
+    latestChart func() (*chart.Chart, error), findings []APIFinding, kubeVersion string) string {
+    chrt, err := latestChart()
+    if err != nil {
+        m.log.Warnf("Failed to download latest chart for %s, cannot check deprecated APIs: %v", rel.Name, err)
+        return fmt.Sprintf("unknown, failed to download %s", latestVersion)
+    }
+
+    manifest, err := renderChart(chrt, rel.Name, rel.Namespace, rel.Config, kubeVersion)
+    if err != nil {
+        m.log.Warnf("Failed to render latest chart %s for %s: %v", latestVersion, rel.Name, err)
+        return fmt.Sprintf("unknown, failed to render %s", latestVersion)
+    }
+
+    var remaining []APIFinding
+    for _, finding := range findings {
+        if usesAPI(manifest, finding) {
+            remaining = append(remaining, finding)
+        }
+    }
+    if len(remaining) > 0 {
+        return fmt.Sprintf("no, %s still uses %s", latestVersion, apiFindingKinds(remaining))
+    }
+    return fmt.Sprintf("yes, upgrade to %s", latestVersion)
+}
@@ -0,0 +1,436 @@
+package helm
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "regexp"
+    "strings"
+    "time"
+    "helm.sh/helm/v3/pkg/action"
+    "helm.sh/helm/v3/pkg/chart"
+    "helm.sh/helm/v3/pkg/release"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const defaultUpgradeTimeout = 10 * time.Minute
+
+// bumpRanks orders the bump levels a policy allows.
+var bumpRanks = map[string]int{"patch": 1, "minor": 2, "major": 3}
+
+type UpgradePolicyConfig struct {
+    Name            string             `yaml:"name"`
+    MaxBump         string             `yaml:"max_bump"` // patch (default), minor or major
+    Namespaces      []string           `yaml:"namespaces"`
+    NamespaceLabels map[string]string  `yaml:"namespace_labels"`
+    ReleasePattern  string             `yaml:"release_pattern"` // regular expression matched against the release name
+    Charts          []string           `yaml:"charts"`
+    Windows         []QuietHoursConfig `yaml:"windows"` // maintenance windows, any time when empty
+}
+
+type AutoUpgradeConfig struct {
+    Enabled  bool                  `yaml:"enabled"`
+    Timeout  string                `yaml:"timeout"` // how long to wait for upgraded resources, 10m by default
+    Policies []UpgradePolicyConfig `yaml:"policies"`
+}
+
+type upgradePolicy struct {
+    name     string
+    maxBump  int
+    selector route
+    windows  []*quietHours
+}
+
+// pendingUpgrade is an upgrade a policy allows. Checks only queue upgrades,
+// they run after the check, see runUpgrades.
+type pendingUpgrade struct {
+    release   *release.Release
+    chartName string
+    chart     *chart.Chart
+    policy    string
+    owner     string
+    timeout   time.Duration
+}
+
+// upgrader applies the upgrade policies during one check, caching namespace
+// labels and collecting the upgrades to run.
+type upgrader struct {
+    m        *Monitor
+    policies []upgradePolicy
+    timeout  time.Duration
+    labels   map[string]map[string]string
+    failed   map[string]string // chart version whose upgrade failed per namespace/name
+    pending  []pendingUpgrade
+}
+
+// upgradeOutcome tells what an upgrade left behind.
+type upgradeOutcome int
+
+const (
+    upgradeSucceeded upgradeOutcome = iota
+    upgradeFailed                   // failed without a rollback, e.g. before changing the release
+    upgradeRolledBack               // failed and was rolled back by the atomic upgrade
+    upgradeRollbackFailed           // failed and so did the rollback
+    upgradeBusy                     // another Helm operation is in progress or the release changed
+)
+
+// autoUpgradeEnabled lets AUTO_UPGRADE switch automatic upgrades on or off
+// without editing the configuration.
+func autoUpgradeEnabled(config AutoUpgradeConfig) bool {
+    switch strings.ToLower(os.Getenv("AUTO_UPGRADE")) {
+    case "true", "1", "yes":
+        return true
+    case "false", "0", "no":
+        return false
+    }
+    return config.Enabled
+}
+
+func parseUpgradeTimeout(config AutoUpgradeConfig) (time.Duration, error) {
+    if config.Timeout == "" {
+        return defaultUpgradeTimeout, nil
+    }
+    timeout, err := time.ParseDuration(config.Timeout)
+    if err != nil || timeout <= 0 {
+        return 0, fmt.Errorf("invalid timeout %q", config.Timeout)
+    }
+    return timeout, nil
+}
+
+func parseUpgradePolicy(config UpgradePolicyConfig) (*upgradePolicy, error) {
+    // A policy without selectors would upgrade every release in the cluster
+    if len(config.Namespaces) == 0 && len(config.NamespaceLabels) == 0 && config.ReleasePattern == "" && len(config.Charts) == 0 {
+        return nil, fmt.Errorf("select releases with namespaces, namespace_labels, release_pattern or charts")
+    }
+    p := &upgradePolicy{name: config.Name, maxBump: bumpRanks["patch"]}
+    if config.MaxBump != "" {
+        rank, ok := bumpRanks[strings.ToLower(config.MaxBump)]
+        if !ok {
+            return nil, fmt.Errorf("invalid max_bump '%s', expected patch, minor or major", config.MaxBump)
+        }
+        p.maxBump = rank
+    }
+    if _, err := regexp.Compile(config.ReleasePattern); err != nil {
+        return nil, fmt.Errorf("invalid release_pattern '%s': %v", config.ReleasePattern, err)
+    }
+    p.selector = newRoute(RouteConfig{
+        Namespaces:      config.Namespaces,
+        NamespaceLabels: config.NamespaceLabels,
+        ReleasePattern:  config.ReleasePattern,
+        Charts:          config.Charts,
+    })
+    for i, w := range config.Windows {
+        window, err := parseQuietHours(w)
+        if err != nil {
+            return nil, fmt.Errorf("maintenance window %d is invalid: %v", i+1, err)
+        }
+        p.windows = append(p.windows, window)
+    }
+    return p, nil
+}
+
+// validateAutoUpgradeConfig reports invalid policies when the configuration
+// is loaded.
+func validateAutoUpgradeConfig(config AutoUpgradeConfig) []string {
+    var errs []string
+    if _, err := parseUpgradeTimeout(config); err != nil {
+        errs = append(errs, fmt.Sprintf("Auto upgrade %v", err))
+    }
+    for i, pc := range config.Policies {
+        if pc.Name == "" {
+            errs = append(errs, fmt.Sprintf("Upgrade policy %d has no name", i+1))
+        }
+        if _, err := parseUpgradePolicy(pc); err != nil {
+            errs = append(errs, fmt.Sprintf("Upgrade policy %d (%s) is invalid: %v", i+1, pc.Name, err))
+        }
+    }
+    return errs
+}
+
+// newUpgrader returns nil when automatic upgrades are disabled. Invalid
+// policies are skipped, they are reported by loadConfig.
+func (m *Monitor) newUpgrader() *upgrader {
+    config := m.config.AutoUpgrade
+    if !autoUpgradeEnabled(config) {
+        return nil
+    }
+
+    u := &upgrader{m: m, timeout: defaultUpgradeTimeout, labels: make(map[string]map[string]string)}
+    if timeout, err := parseUpgradeTimeout(config); err == nil {
+        u.timeout = timeout
+    }
+    for _, pc := range config.Policies {
+        if p, err := parseUpgradePolicy(pc); err == nil {
+            u.policies = append(u.policies, *p)
+        }
+    }
+    if len(u.policies) == 0 {
+        m.log.Warn("Automatic upgrades are enabled without valid policies, no release will be upgraded")
+        return nil
+    }
+    if m.store != nil {
+        state, err := m.store.Load()
+        if err != nil {
+            // Without the failed upgrades, broken upgrades would be retried
+            m.log.Errorf("Skipping automatic upgrades: %v", err)
+            return nil
+        }
+        u.failed = state.FailedUpgrades
+    }
+    return u
+}
+
+func (u *upgrader) namespaceLabels(namespace string) map[string]string {
+    if labels, ok := u.labels[namespace]; ok {
+        return labels
+    }
+    var labels map[string]string
+    ns, err := u.m.client.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
+    if err != nil {
+        u.m.log.Debugf("Failed to get namespace %s for upgrade policies: %v", namespace, err)
+    } else {
+        labels = ns.Labels
+    }
+    u.labels[namespace] = labels
+    return labels
+}
+
+// inWindow reports whether t falls in one of the maintenance windows.
+func (p *upgradePolicy) inWindow(t time.Time) bool {
+    if len(p.windows) == 0 {
+        return true
+    }
+    for _, w := range p.windows {
+        if !w.until(t).IsZero() {
+            return true
+        }
+    }
+    return false
+}
+
+// policyFor returns the first policy that selects the release and allows
+// the bump, or nil. A policy outside its maintenance window does not apply.
+func (u *upgrader) policyFor(rel *release.Release, chartName, bump string, now time.Time) *upgradePolicy {
+    item := ReportItem{Namespace: rel.Namespace, Release: rel.Name, Chart: chartName}
+    for i := range u.policies {
+        p := &u.policies[i]
+        if !p.selector.matches(item, u.namespaceLabels) || bumpRanks[bump] > p.maxBump {
+            continue
+        }
+        if !p.inWindow(now) {
+            u.m.log.Debugf("Helm release %s in namespace: %s matches upgrade policy %s outside its maintenance window",
+                rel.Name, rel.Namespace, p.name)
+            continue
+        }
+        return p
+    }
+    return nil
+}
+
+// queue queues the upgrade of the release to the chart when a policy allows
+// it and returns the name of the policy, or "". Upgrades that failed before
+// are not retried for the same chart version.
+func (u *upgrader) queue(rel *release.Release, chartName string, chrt *chart.Chart, bump, owner string) string {
+    p := u.policyFor(rel, chartName, bump, time.Now())
+    if p == nil {
+        return ""
+    }
+
+    latestVersion := chrt.Metadata.Version
+    if u.failed[rel.Namespace+"/"+rel.Name] == latestVersion {
+        u.m.log.Infof("Skipping automatic upgrade of helm release %s in namespace: %s to chart %s, it failed before",
+            rel.Name, rel.Namespace, latestVersion)
+        return ""
+    }
+
+    u.m.log.Infof("Queued automatic upgrade of helm release %s in namespace: %s from chart %s to %s by policy %s",
+        rel.Name, rel.Namespace, rel.Chart.Metadata.Version, latestVersion, p.name)
+    u.pending = append(u.pending, pendingUpgrade{
+        release:   rel,
+        chartName: chartName,
+        chart:     chrt,
+        policy:    p.name,
+        owner:     owner,
+        timeout:   u.timeout,
+    })
+    return p.name
+}
+
+// classifyUpgradeError tells from the error of an atomic upgrade whether
+// Helm rolled the release back.
+func classifyUpgradeError(err error) upgradeOutcome {
+    msg := err.Error()
+    switch {
+    case strings.Contains(msg, "has been rolled back due to atomic being set"):
+        return upgradeRolledBack
+    case strings.Contains(msg, "an error occurred while rolling back the release"):
+        return upgradeRollbackFailed
+    case strings.Contains(msg, "another operation (install/upgrade/rollback) is in progress"):
+        return upgradeBusy
+    default:
+        return upgradeFailed
+    }
+}
+
+// upgradeRelease upgrades the release to the chart with its current values.
+// Atomic upgrades wait for the resources to become ready and roll back when
+// they do not within the timeout or ctx ends. The release is skipped when it
+// changed since the check queued the upgrade.
+func (m *Monitor) upgradeRelease(ctx context.Context, p pendingUpgrade) (*release.Release, upgradeOutcome, error) {
+    actionConfig, err := m.newActionConfig(p.release.Namespace)
+    if err != nil {
+        return nil, upgradeFailed, err
+    }
+
+    current, err := actionConfig.Releases.Last(p.release.Name)
+    if err != nil {
+        return nil, upgradeFailed, fmt.Errorf("failed to get current revision: %v", err)
+    }
+    if current.Version != p.release.Version {
+        return current, upgradeBusy, fmt.Errorf("release changed to revision %d since the check", current.Version)
+    }
+
+    upgrade := action.NewUpgrade(actionConfig)
+    upgrade.Namespace = p.release.Namespace
+    upgrade.Atomic = true
+    upgrade.Wait = true
+    upgrade.CleanupOnFail = true
+    upgrade.Timeout = p.timeout
+    upgrade.Description = fmt.Sprintf("Upgraded by helm-monitor policy %s", p.policy)
+
+    upgraded, err := upgrade.RunWithContext(ctx, p.release.Name, p.chart, p.release.Config)
+    if err != nil {
+        return nil, classifyUpgradeError(err), err
+    }
+    return upgraded, upgradeSucceeded, nil
+}
+
+// setFailedUpgrade records the chart version whose upgrade failed for a
+// release in the shared state, so no replica retries it after a restart or
+// failover. An empty version forgets it.
+func (m *Monitor) setFailedUpgrade(key, version string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.store == nil {
+        return
+    }
+
+    state, err := m.store.Load()
+    if err != nil {
+        m.log.Errorf("Failed to record automatic upgrade result: %v", err)
+        return
+    }
+    if version == "" {
+        if _, ok := state.FailedUpgrades[key]; !ok {
+            return
+        }
+        delete(state.FailedUpgrades, key)
+    } else {
+        if state.FailedUpgrades == nil {
+            state.FailedUpgrades = make(map[string]string)
+        }
+        state.FailedUpgrades[key] = version
+    }
+    if err := m.store.Save(state); err != nil {
+        m.log.Errorf("Failed to record automatic upgrade result: %v", err)
+    }
+}
+
+// reportUpgrade posts the result of an upgrade and records its event.
+func (m *Monitor) reportUpgrade(item ReportItem, event releaseEvent) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    m.recordEvents([]releaseEvent{event})
+    if m.notifier != nil {
+        if err := m.notifier.SendActions(ReportSection{Title: "Automatic Upgrades", Items: []ReportItem{item}}); err != nil {
+            m.log.Errorf("Failed to report automatic upgrade: %v", err)
+        }
+    }
+}
+
+// runUpgrades runs the upgrades queued by a check one by one. It runs
+// outside the check lock, so scheduled, webhook and release checks go on
+// while upgraded releases become ready, and stops when the leader term ends.
+func (m *Monitor) runUpgrades(ctx context.Context, pending []pendingUpgrade) {
+    if len(pending) == 0 {
+        return
+    }
+    // Checks during the upgrades queue them again, the release is skipped
+    // once its revision changed
+    if !m.upgrading.TryLock() {
+        m.log.Info("Automatic upgrades of an earlier check are still running, later checks queue the rest")
+        return
+    }
+    defer m.upgrading.Unlock()
+
+    upgraded := make(map[string]bool)
+    for _, p := range pending {
+        if ctx.Err() != nil || !m.leader.Load() {
+            m.log.Warn("Leadership lost, stopping automatic upgrades")
+            break
+        }
+        if m.runUpgrade(ctx, p) {
+            upgraded[p.release.Namespace+"/"+p.release.Name] = true
+        }
+    }
+
+    // The release watcher checks upgraded releases by itself
+    if !releaseWatchEnabled() && ctx.Err() == nil {
+        m.checkReleaseSet(upgraded)
+    }
+}
+
+// runUpgrade upgrades one release and reports the result. It returns whether
+// the release was upgraded.
+func (m *Monitor) runUpgrade(ctx context.Context, p pendingUpgrade) bool {
+    rel := p.release
+    key := rel.Namespace + "/" + rel.Name
+    currentVersion := rel.Chart.Metadata.Version
+    latestVersion := p.chart.Metadata.Version
+    m.log.Infof("Upgrading helm release %s in namespace: %s from chart %s to %s by policy %s",
+        rel.Name, rel.Namespace, currentVersion, latestVersion, p.policy)
+
+    upgraded, outcome, err := m.upgradeRelease(ctx, p)
+    switch {
+    case outcome == upgradeSucceeded:
+        m.setFailedUpgrade(key, "")
+        m.log.Infof("Upgraded helm release %s in namespace: %s to chart %s, revision %d",
+            rel.Name, rel.Namespace, latestVersion, upgraded.Version)
+        item := newReportItem("auto-upgrade", rel.Namespace, rel.Name, p.chartName, latestVersion+"/upgraded",
+            fmt.Sprintf("•    *release*: %s\n      *namespace*: %s\n      :white_check_mark: *upgraded*: %s -> %s (revision %d, policy %s)\n",
+                rel.Name, rel.Namespace, currentVersion, latestVersion, upgraded.Version, p.policy))
+        item.Owner = p.owner
+        m.reportUpgrade(item, autoUpgradedEvent(upgraded, item.Key, p.chartName, currentVersion, p.policy))
+        return true
+
+    case outcome == upgradeBusy:
+        m.log.Infof("Skipping automatic upgrade of helm release %s in namespace: %s: %v", rel.Name, rel.Namespace, err)
+        return false
+
+    case ctx.Err() != nil && outcome != upgradeRollbackFailed:
+        // Not the fault of the chart, the next leader queues it again
+        m.log.Warnf("Automatic upgrade of helm release %s in namespace: %s to chart %s was interrupted: %v",
+            rel.Name, rel.Namespace, latestVersion, err)
+        return false
+    }
+
+    m.log.Errorf("Automatic upgrade of helm release %s in namespace: %s to chart %s failed: %v",
+        rel.Name, rel.Namespace, latestVersion, err)
+    m.setFailedUpgrade(key, latestVersion)
+
+    result := ":x: *upgrade failed*"
+    switch outcome {
+    case upgradeRolledBack:
+        result = ":x: *upgrade failed and was rolled back*"
+    case upgradeRollbackFailed:
+        result = ":rotating_light: *upgrade failed and so did the rollback, the release needs attention*"
+    }
+    reason := truncateText(strings.SplitN(err.Error(), "\n", 2)[0], 500)
+    item := newReportItem("auto-upgrade", rel.Namespace, rel.Name, p.chartName, latestVersion+"/failed",
+        fmt.Sprintf("•    *release*: %s\n      *namespace*: %s\n      %s: %s -> %s (policy %s)\n      *reason*: %s\n",
+            rel.Name, rel.Namespace, result, currentVersion, latestVersion, p.policy, reason))
+    item.Owner = p.owner
+    m.reportUpgrade(item, autoUpgradeFailedEvent(rel, item.Key, p.chartName, latestVersion, p.policy, reason, outcome))
+    return false
+}
@@ -0,0 +1,255 @@
+package helm
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+    "k8s.io/apimachinery/pkg/api/equality"
+    apierrors "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+    "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/apimachinery/pkg/runtime/schema"
+    "k8s.io/client-go/dynamic/dynamicinformer"
+    "k8s.io/client-go/tools/cache"
+)
+
+const chartWatchResync = 10 * time.Minute
+
+var chartWatchResource = schema.GroupVersionResource{
+    Group:    "helm-monitor.io",
+    Version:  "v1alpha1",
+    Resource: "chartwatches",
+}
+
+// ChartWatchSpec lets a team register its own releases in its namespace.
+type ChartWatchSpec struct {
+    Repository struct {
+        Name string `json:"name,omitempty"`
+        URL  string `json:"url"`
+    } `json:"repository"`
+    Chart           string `json:"chart"`
+    ReleaseSelector struct {
+        Names       []string          `json:"names,omitempty"`
+        MatchLabels map[string]string `json:"matchLabels,omitempty"`
+    } `json:"releaseSelector"`
+    Policy struct {
+        AlertOn string `json:"alertOn,omitempty"`
+    } `json:"policy,omitempty"`
+    Notification struct {
+        Channel string `json:"channel,omitempty"`
+    } `json:"notification,omitempty"`
+}
+
+type ChartWatchStatus struct {
+    Ready              bool   `json:"ready"`
+    Message            string `json:"message,omitempty"`
+    ObservedGeneration int64  `json:"observedGeneration"`
+}
+
+type chartWatch struct {
+    namespace, name string
+    spec            ChartWatchSpec
+}
+
+func operatorMode() bool {
+    switch strings.ToLower(os.Getenv("OPERATOR_MODE")) {
+    case "true", "1", "yes":
+        return true
+    }
+    return false
+}
+
+func validateChartWatch(spec ChartWatchSpec) error {
+    var errs []string
+    if spec.Repository.URL == "" {
+        errs = append(errs, "repository.url is required")
+    }
+    if spec.Chart == "" {
+        errs = append(errs, "chart is required")
+    }
+    if len(spec.ReleaseSelector.Names) == 0 && len(spec.ReleaseSelector.MatchLabels) == 0 {
+        errs = append(errs, "releaseSelector needs names or matchLabels")
+    }
+    switch spec.Policy.AlertOn {
+    case "", AlertOnChartVersion, AlertOnAppVersion, AlertOnAny:
+    default:
+        errs = append(errs, fmt.Sprintf("policy.alertOn '%s' is invalid, expected %s, %s or %s",
+            spec.Policy.AlertOn, AlertOnChartVersion, AlertOnAppVersion, AlertOnAny))
+    }
+    if len(errs) > 0 {
+        return fmt.Errorf("%s", strings.Join(errs, ", "))
+    }
+    return nil
+}
+
+// repoConfig turns a ChartWatch into the repository configuration of its
+// releases, scoped to the namespace of the ChartWatch.
+func (w *chartWatch) repoConfig() RepoConfig {
+    name := w.spec.Repository.Name
+    if name == "" {
+        name = w.namespace + "/" + w.name
+    }
+    repo := RepoConfig{Name: name, URL: w.spec.Repository.URL, Charts: make(map[string]ChartMapping)}
+    for _, release := range w.spec.ReleaseSelector.Names {
+        repo.Charts[release] = ChartMapping{
+            InstalledName: release,
+            RemoteName:    w.spec.Chart,
+            AlertOn:       w.spec.Policy.AlertOn,
+            Namespace:     w.namespace,
+        }
+    }
+    if len(w.spec.ReleaseSelector.MatchLabels) > 0 {
+        repo.Charts[w.name] = ChartMapping{
+            RemoteName:    w.spec.Chart,
+            AlertOn:       w.spec.Policy.AlertOn,
+            Namespace:     w.namespace,
+            ReleaseLabels: w.spec.ReleaseSelector.MatchLabels,
+        }
+    }
+    return repo
+}
+
+// route sends the findings of the ChartWatch releases to its channel.
+func (w *chartWatch) route() (RouteConfig, bool) {
+    if w.spec.Notification.Channel == "" {
+        return RouteConfig{}, false
+    }
+    route := RouteConfig{
+        Channel:    w.spec.Notification.Channel,
+        Namespaces: []string{w.namespace},
+        Charts:     []string{w.spec.Chart},
+    }
+    // Releases selected by labels are routed by namespace and chart only
+    if len(w.spec.ReleaseSelector.Names) > 0 && len(w.spec.ReleaseSelector.MatchLabels) == 0 {
+        var names []string
+        for _, name := range w.spec.ReleaseSelector.Names {
+            names = append(names, regexp.QuoteMeta(name))
+        }
+        route.ReleasePattern = "^(" + strings.Join(names, "|") + ")$"
+    }
+    return route, true
+}
+
+// mergeChartWatches adds the ChartWatches to the file configuration. The file
+// configuration comes first, so its repositories and routes win for releases
+// selected twice and a ChartWatch cannot take over notifications the
+// operator already routes.
+func mergeChartWatches(base *Config, watches []*chartWatch) *Config {
+    merged := *base
+    merged.Repositories = append([]RepoConfig(nil), base.Repositories...)
+    merged.Notifications.Routes = append([]RouteConfig(nil), base.Notifications.Routes...)
+    for _, w := range watches {
+        merged.Repositories = append(merged.Repositories, w.repoConfig())
+        if route, ok := w.route(); ok {
+            merged.Notifications.Routes = append(merged.Notifications.Routes, route)
+        }
+    }
+    return &merged
+}
+
+// watchChartWatches reconciles ChartWatch resources with an informer until
+// ctx is done.
+func (m *Monitor) watchChartWatches(ctx context.Context) {
+    if !operatorMode() || m.dynamic == nil || m.fileConfig == nil {
+        return
+    }
+
+    factory := dynamicinformer.NewDynamicSharedInformerFactory(m.dynamic, chartWatchResync)
+    informer := factory.ForResource(chartWatchResource).Informer()
+
+    // Changes are coalesced, a reconcile always works on the whole store
+    changed := make(chan struct{}, 1)
+    notify := func() {
+        select {
+        case changed <- struct{}{}:
+        default:
+        }
+    }
+    informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+        AddFunc:    func(interface{}) { notify() },
+        UpdateFunc: func(interface{}, interface{}) { notify() },
+        DeleteFunc: func(interface{}) { notify() },
+    })
+
+    m.log.Info("Operator mode enabled, watching ChartWatch resources")
+    factory.Start(ctx.Done())
+    if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+        m.log.Error("Failed to sync ChartWatch informer, is the CRD installed?")
+        return
+    }
+    notify()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-changed:
+            m.reconcileChartWatches(informer.GetStore().List())
+        }
+    }
+}
+
+func (m *Monitor) reconcileChartWatches(objects []interface{}) {
+    var watches []*chartWatch
+    for _, o := range objects {
+        obj, ok := o.(*unstructured.Unstructured)
+        if !ok {
+            continue
+        }
+        w := &chartWatch{namespace: obj.GetNamespace(), name: obj.GetName()}
+
+        spec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+        err := runtime.DefaultUnstructuredConverter.FromUnstructured(spec, &w.spec)
+        if err == nil {
+            err = validateChartWatch(w.spec)
+        }
+
+        status := ChartWatchStatus{Ready: err == nil, ObservedGeneration: obj.GetGeneration()}
+        if err != nil {
+            status.Message = err.Error()
+            m.log.Warnf("ChartWatch %s in namespace: %s is invalid: %v", w.name, w.namespace, err)
+        } else {
+            status.Message = fmt.Sprintf("Watching chart %s from %s", w.spec.Chart, w.spec.Repository.URL)
+            watches = append(watches, w)
+        }
+        m.updateChartWatchStatus(obj, status)
+    }
+
+    sort.Slice(watches, func(i, j int) bool {
+        return watches[i].namespace+"/"+watches[i].name < watches[j].namespace+"/"+watches[j].name
+    })
+    config := mergeChartWatches(m.fileConfig, watches)
+
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.config = config
+    if m.notifier != nil {
+        m.notifier.setRoutes(config.Notifications)
+    }
+    m.log.Infof("Reconciled %d ChartWatch resources", len(watches))
+}
+
+func (m *Monitor) updateChartWatchStatus(obj *unstructured.Unstructured, status ChartWatchStatus) {
+    desired, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+    if err != nil {
+        return
+    }
+    current, _, _ := unstructured.NestedMap(obj.Object, "status")
+    if equality.Semantic.DeepEqual(current, desired) {
+        return
+    }
+
+    obj = obj.DeepCopy()
+    obj.Object["status"] = desired
+    _, err = m.dynamic.Resource(chartWatchResource).Namespace(obj.GetNamespace()).
+        UpdateStatus(context.TODO(), obj, metav1.UpdateOptions{})
+    if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+        m.log.Errorf("Failed to update status of ChartWatch %s in namespace: %s: %v",
+            obj.GetName(), obj.GetNamespace(), err)
+    }
+}
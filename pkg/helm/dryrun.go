@@ -0,0 +1,278 @@
+package helm
+
+import (
+    "bytes"
+    "fmt"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+    "gopkg.in/yaml.v2"
+    "helm.sh/helm/v3/pkg/action"
+    "helm.sh/helm/v3/pkg/chart"
+    "helm.sh/helm/v3/pkg/cli"
+    "helm.sh/helm/v3/pkg/release"
+    "helm.sh/helm/v3/pkg/releaseutil"
+    apierrors "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+    "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/apimachinery/pkg/types"
+    "k8s.io/cli-runtime/pkg/resource"
+)
+
+const (
+    maxDiffNames = 10
+    // dryRunFieldManager owns the fields of the dry-run applies, nothing is
+    // persisted under it
+    dryRunFieldManager = "helm-monitor-dry-run"
+)
+
+// ManifestDiff lists the resources an upgrade adds, removes and changes, as
+// Kind/name.
+type ManifestDiff struct {
+    Added   []string
+    Removed []string
+    Changed []string
+}
+
+// dryRunResult is the outcome of simulating the upgrade of a release
+// revision to a chart version.
+type dryRunResult struct {
+    revision      int
+    latestVersion string
+    err           error
+    forbidden     bool // the service account may not read resources the chart deploys
+    diff          ManifestDiff
+}
+
+// rbacDeniedRegex matches the reason of the API server's authorizer, other
+// Forbidden errors like PodSecurity violations or exceeded quotas are
+// rejections of the chart.
+var rbacDeniedRegex = regexp.MustCompile(` cannot [a-z]+ (resource|path) `)
+
+// isForbidden reports whether the dry-run failed on missing permissions of
+// helm-monitor rather than on the chart. Helm wraps the API errors it gets
+// when looking up existing resources, some only keep the message.
+func isForbidden(err error) bool {
+    return (apierrors.IsForbidden(err) || strings.Contains(err.Error(), " is forbidden: ")) &&
+        rbacDeniedRegex.MatchString(err.Error())
+}
+
+func upgradeDryRunEnabled() bool {
+    switch strings.ToLower(os.Getenv("UPGRADE_DRY_RUN")) {
+    case "false", "0", "no":
+        return false
+    }
+    return true
+}
+
+// newActionConfig returns a Helm action configuration for one namespace.
+// Resources without a namespace in the manifest go to that namespace, like
+// with helm --namespace.
+func (m *Monitor) newActionConfig(namespace string) (*action.Configuration, error) {
+    settings := cli.New()
+    settings.SetNamespace(namespace)
+    actionConfig := new(action.Configuration)
+    if err := actionConfig.Init(settings.RESTClientGetter(), namespace, os.Getenv("HELM_DRIVER"), m.log.Debugf); err != nil {
+        return nil, fmt.Errorf("failed to init action config: %v", err)
+    }
+    return actionConfig, nil
+}
+
+// manifestObjects maps Kind/name to the manifest of each resource, without
+// the source comments Helm adds.
+func manifestObjects(manifest string) map[string]string {
+    objects := make(map[string]string)
+    for _, doc := range releaseutil.SplitManifests(manifest) {
+        var res manifestResource
+        if err := yaml.Unmarshal([]byte(doc), &res); err != nil || res.Kind == "" {
+            continue
+        }
+        var lines []string
+        for _, line := range strings.Split(doc, "\n") {
+            if !strings.HasPrefix(line, "# Source:") {
+                lines = append(lines, line)
+            }
+        }
+        objects[res.Kind+"/"+res.Metadata.Name] = strings.TrimSpace(strings.Join(lines, "\n"))
+    }
+    return objects
+}
+
+func diffManifests(current, upgraded string) ManifestDiff {
+    before := manifestObjects(current)
+    after := manifestObjects(upgraded)
+
+    var diff ManifestDiff
+    for key, doc := range after {
+        previous, exists := before[key]
+        switch {
+        case !exists:
+            diff.Added = append(diff.Added, key)
+        case previous != doc:
+            diff.Changed = append(diff.Changed, key)
+        }
+    }
+    for key := range before {
+        if _, exists := after[key]; !exists {
+            diff.Removed = append(diff.Removed, key)
+        }
+    }
+    sort.Strings(diff.Added)
+    sort.Strings(diff.Removed)
+    sort.Strings(diff.Changed)
+    return diff
+}
+
+// simulateUpgrade renders the upgrade of the release to the chart with its
+// current values and checks it for conflicts with existing resources, like
+// helm upgrade --dry-run=server. Helm stops before sending anything to the API
+// server, so the rendered resources are then applied with a server side
+// dry-run, which runs the schema, field and admission validation of a real
+// upgrade without changing anything.
+func (m *Monitor) simulateUpgrade(rel *release.Release, chrt *chart.Chart) (*release.Release, error) {
+    actionConfig, err := m.newActionConfig(rel.Namespace)
+    if err != nil {
+        return nil, err
+    }
+
+    upgrade := action.NewUpgrade(actionConfig)
+    upgrade.Namespace = rel.Namespace
+    upgrade.DryRun = true
+    upgrade.DryRunOption = "server"
+
+    upgraded, err := upgrade.Run(rel.Name, chrt, rel.Config)
+    if err != nil {
+        return nil, err
+    }
+    if err := validateOnServer(actionConfig, upgraded.Manifest); err != nil {
+        return nil, err
+    }
+    return upgraded, nil
+}
+
+// validateOnServer applies each resource of the manifest with dryRun=All.
+// Rejected resources are reported together. Missing permissions are only
+// returned when the API server accepted everything it was allowed to see,
+// so a broken chart is not reported as an RBAC problem.
+func validateOnServer(actionConfig *action.Configuration, manifest string) error {
+    resources, err := actionConfig.KubeClient.Build(bytes.NewBufferString(manifest), false)
+    if err != nil {
+        return fmt.Errorf("failed to build resources: %v", err)
+    }
+
+    var rejected []string
+    var forbidden error
+    force := true
+    for _, info := range resources {
+        data, err := runtime.Encode(unstructured.UnstructuredJSONScheme, info.Object)
+        if err != nil {
+            return fmt.Errorf("failed to encode %s %s: %v", info.Mapping.GroupVersionKind.Kind, info.Name, err)
+        }
+        helper := resource.NewHelper(info.Client, info.Mapping).
+            DryRun(true).
+            WithFieldManager(dryRunFieldManager).
+            WithFieldValidation(metav1.FieldValidationStrict)
+        _, err = helper.Patch(info.Namespace, info.Name, types.ApplyPatchType, data, &metav1.PatchOptions{Force: &force})
+        switch {
+        case err == nil:
+        case isForbidden(err):
+            if forbidden == nil {
+                forbidden = err
+            }
+        default:
+            rejected = append(rejected, fmt.Sprintf("%s %s: %v", info.Mapping.GroupVersionKind.Kind, info.Name, err))
+        }
+    }
+    if len(rejected) > 0 {
+        return fmt.Errorf("API server rejected %s", strings.Join(rejected, "; "))
+    }
+    return forbidden
+}
+
+// newDryRunResult maps the outcome of simulating the upgrade of rel to a
+// result, upgraded is nil when the simulation failed.
+func newDryRunResult(rel *release.Release, chartVersion string, upgraded *release.Release, err error) *dryRunResult {
+    result := &dryRunResult{revision: rel.Version, latestVersion: chartVersion, err: err}
+    switch {
+    case err != nil:
+        result.forbidden = isForbidden(err)
+    case upgraded != nil:
+        result.diff = diffManifests(rel.Manifest, upgraded.Manifest)
+    }
+    return result
+}
+
+// upgradeDryRun simulates the upgrade once per release revision and chart
+// version, later checks reuse the result.
+func (m *Monitor) upgradeDryRun(rel *release.Release, chrt *chart.Chart) *dryRunResult {
+    key := rel.Namespace + "/" + rel.Name
+    if cached, ok := m.dryRuns[key]; ok && cached.revision == rel.Version && cached.latestVersion == chrt.Metadata.Version {
+        return cached
+    }
+
+    upgraded, err := m.simulateUpgrade(rel, chrt)
+    result := newDryRunResult(rel, chrt.Metadata.Version, upgraded, err)
+    switch result.status() {
+    case "not-validated":
+        m.log.Warnf("Upgrade dry-run of helm release %s in namespace: %s to chart %s could not be validated, missing permissions: %v",
+            rel.Name, rel.Namespace, chrt.Metadata.Version, err)
+    case "failed":
+        m.log.Warnf("Upgrade dry-run of helm release %s in namespace: %s to chart %s failed: %v",
+            rel.Name, rel.Namespace, chrt.Metadata.Version, err)
+    default:
+        m.log.Infof("Upgrade dry-run of helm release %s in namespace: %s to chart %s passed: %d added, %d removed, %d changed",
+            rel.Name, rel.Namespace, chrt.Metadata.Version, len(result.diff.Added), len(result.diff.Removed), len(result.diff.Changed))
+    }
+
+    if m.dryRuns == nil {
+        m.dryRuns = make(map[string]*dryRunResult)
+    }
+    m.dryRuns[key] = result
+    return result
+}
+
+func (r *dryRunResult) status() string {
+    switch {
+    case r.forbidden:
+        return "not-validated"
+    case r.err != nil:
+        return "failed"
+    default:
+        return "passed"
+    }
+}
+
+func formatNames(names []string) string {
+    if len(names) > maxDiffNames {
+        return fmt.Sprintf("%s and %d more", strings.Join(names[:maxDiffNames], ", "), len(names)-maxDiffNames)
+    }
+    return strings.Join(names, ", ")
+}
+
+func (r *dryRunResult) format() string {
+    if r.err != nil {
+        reason := truncateText(strings.SplitN(r.err.Error(), "\n", 2)[0], 500)
+        if r.forbidden {
+            return fmt.Sprintf("      :warning: *upgrade dry-run not validated (RBAC)*: %s\n", reason)
+        }
+        return fmt.Sprintf("      :x: *upgrade dry-run failed*: %s\n", reason)
+    }
+
+    msg := fmt.Sprintf("      :white_check_mark: *upgrade dry-run*: renders and the API server accepts it, %d added, %d removed, %d changed\n",
+        len(r.diff.Added), len(r.diff.Removed), len(r.diff.Changed))
+    for _, part := range []struct {
+        label string
+        names []string
+    }{
+        {"added", r.diff.Added},
+        {"removed", r.diff.Removed},
+        {"changed", r.diff.Changed},
+    } {
+        if len(part.names) > 0 {
+            msg += fmt.Sprintf("        %s: %s\n", part.label, formatNames(part.names))
+        }
+    }
+    return msg
+}
@@ -0,0 +1,170 @@
+package helm
+
+import (
+    "errors"
+    "fmt"
+    "reflect"
+    "strings"
+    "testing"
+
+    "helm.sh/helm/v3/pkg/release"
+    apierrors "k8s.io/apimachinery/pkg/api/errors"
+    "k8s.io/apimachinery/pkg/runtime/schema"
+    "k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const (
+    testCurrentManifest = `---
+# Source: app/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+spec:
+  ports:
+    - port: 80
+---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: 1
+---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-legacy
+`
+    testUpgradedManifest = `---
+# Source: app/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+spec:
+  ports:
+    - port: 80
+---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: 2
+---
+# Source: app/templates/pdb.yaml
+apiVersion: policy/v1
+kind: PodDisruptionBudget
+metadata:
+  name: app
+`
+)
+
+func TestNewDryRunResult(t *testing.T) {
+    rel := &release.Release{Name: "app", Namespace: "apps", Version: 3, Manifest: testCurrentManifest}
+    upgraded := &release.Release{Name: "app", Namespace: "apps", Version: 4, Manifest: testUpgradedManifest}
+
+    forbidden := apierrors.NewForbidden(schema.GroupResource{Group: "policy", Resource: "poddisruptionbudgets"}, "app",
+        errors.New(`User "system:serviceaccount:helm-monitor:helm-monitor" cannot patch resource "poddisruptionbudgets" in API group "policy" in the namespace "apps"`))
+    invalid := apierrors.NewInvalid(schema.GroupKind{Group: "apps", Kind: "Deployment"}, "app",
+        field.ErrorList{field.Invalid(field.NewPath("spec", "replicas"), -1, "must be greater than or equal to 0")})
+
+    tests := []struct {
+        name     string
+        upgraded *release.Release
+        err      error
+        status   string
+        diff     ManifestDiff
+        format   string
+    }{
+        {
+            name:     "passed",
+            upgraded: upgraded,
+            status:   "passed",
+            diff: ManifestDiff{
+                Added:   []string{"PodDisruptionBudget/app"},
+                Removed: []string{"ConfigMap/app-legacy"},
+                Changed: []string{"Deployment/app"},
+            },
+            format: ":white_check_mark: *upgrade dry-run*: renders and the API server accepts it, 1 added, 1 removed, 1 changed",
+        },
+        {
+            name:   "rejected by the API server",
+            err:    fmt.Errorf("API server rejected Deployment app: %v", invalid),
+            status: "failed",
+            format: ":x: *upgrade dry-run failed*: API server rejected Deployment app",
+        },
+        {
+            name:   "render error",
+            err:    errors.New("template: app/templates/deployment.yaml:7:20: executing \"app/templates/deployment.yaml\" at <.Values.image.tag>: nil pointer"),
+            status: "failed",
+            format: ":x: *upgrade dry-run failed*: template:",
+        },
+        {
+            name: "exceeded quota",
+            err: fmt.Errorf("API server rejected PersistentVolumeClaim data: %v", apierrors.NewForbidden(
+                schema.GroupResource{Resource: "persistentvolumeclaims"}, "data",
+                errors.New("exceeded quota: storage, requested: requests.storage=100Gi, used: requests.storage=50Gi, limited: requests.storage=100Gi"))),
+            status: "failed",
+            format: ":x: *upgrade dry-run failed*: API server rejected PersistentVolumeClaim data",
+        },
+        {
+            name:   "forbidden API error",
+            err:    forbidden,
+            status: "not-validated",
+            format: ":warning: *upgrade dry-run not validated (RBAC)*: poddisruptionbudgets.policy \"app\" is forbidden",
+        },
+        {
+            name:   "forbidden message wrapped by Helm",
+            err:    fmt.Errorf("could not get information about the resource PodDisruptionBudget \"app\" in namespace \"apps\": %v", forbidden.Error()),
+            status: "not-validated",
+            format: ":warning: *upgrade dry-run not validated (RBAC)*: could not get information",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            result := newDryRunResult(rel, "2.0.0", tt.upgraded, tt.err)
+            if result.revision != 3 || result.latestVersion != "2.0.0" {
+                t.Errorf("result is for revision %d and version %s, want 3 and 2.0.0", result.revision, result.latestVersion)
+            }
+            if status := result.status(); status != tt.status {
+                t.Errorf("status %q, want %q", status, tt.status)
+            }
+            if !reflect.DeepEqual(result.diff, tt.diff) {
+                t.Errorf("diff %+v, want %+v", result.diff, tt.diff)
+            }
+            if format := result.format(); !strings.Contains(format, tt.format) {
+                t.Errorf("format %q does not contain %q", format, tt.format)
+            }
+        })
+    }
+}
+
+func TestIsForbidden(t *testing.T) {
+    forbidden := apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "app",
+        errors.New(`User "system:serviceaccount:helm-monitor:helm-monitor" cannot get resource "secrets" in API group "" in the namespace "apps"`))
+    podSecurity := apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "app",
+        errors.New(`violates PodSecurity "restricted:latest": allowPrivilegeEscalation != false`))
+    tests := []struct {
+        err  error
+        want bool
+    }{
+        {forbidden, true},
+        {fmt.Errorf("upgrade failed: %w", forbidden), true},
+        {fmt.Errorf("upgrade failed: %s", forbidden.Error()), true},
+        {podSecurity, false},
+        {fmt.Errorf("API server rejected Pod app: %v", podSecurity), false},
+        {apierrors.NewNotFound(schema.GroupResource{Resource: "secrets"}, "app"), false},
+        {errors.New("values don't meet the specifications of the schema"), false},
+    }
+    for _, tt := range tests {
+        if got := isForbidden(tt.err); got != tt.want {
+            t.Errorf("isForbidden(%v) = %t, want %t", tt.err, got, tt.want)
+        }
+    }
+}
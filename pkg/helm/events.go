@@ -0,0 +1,175 @@
+package helm
+
+import (
+    "context"
+    "fmt"
+    "hash/fnv"
+    "os"
+    "strings"
+    "time"
+    corev1 "k8s.io/api/core/v1"
+    apierrors "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "helm.sh/helm/v3/pkg/release"
+)
+
+const (
+    EventReasonChartUpdateAvailable = "ChartUpdateAvailable"
+    EventReasonDeprecatedChart      = "DeprecatedChart"
+    EventReasonReleaseFailed        = "ReleaseFailed"
+    EventReasonAutoUpgraded         = "AutoUpgraded"
+    EventReasonAutoUpgradeFailed    = "AutoUpgradeFailed"
+
+    eventComponent = "helm-monitor"
+)
+
+// releaseEvent is a Kubernetes Event about a finding for a release.
+type releaseEvent struct {
+    key       string // finding key, the event is recorded once per key
+    release   *release.Release
+    eventType string
+    reason    string
+    message   string
+}
+
+func eventsEnabled() bool {
+    switch strings.ToLower(os.Getenv("KUBE_EVENTS")) {
+    case "false", "0", "no":
+        return false
+    }
+    return true
+}
+
+// eventName is stable for a finding, so the same finding is not recorded
+// again on later checks while its event exists.
+func eventName(rel *release.Release, key string) string {
+    h := fnv.New64a()
+    h.Write([]byte(key))
+    return fmt.Sprintf("%s.%x", rel.Name, h.Sum64())
+}
+
+// storageObject is the object Helm stores the release revision in, which
+// events refer to.
+func storageObject(rel *release.Release) corev1.ObjectReference {
+    ref := corev1.ObjectReference{
+        APIVersion: "v1",
+        Kind:       "Secret",
+        Namespace:  rel.Namespace,
+        Name:       fmt.Sprintf("sh.helm.release.v1.%s.v%d", rel.Name, rel.Version),
+    }
+    switch strings.ToLower(os.Getenv("HELM_DRIVER")) {
+    case "configmap", "configmaps":
+        ref.Kind = "ConfigMap"
+    }
+    return ref
+}
+
+func updateEvent(rel *release.Release, key, chartName, currentVersion, latestVersion string) releaseEvent {
+    return releaseEvent{
+        key:       key,
+        release:   rel,
+        eventType: corev1.EventTypeNormal,
+        reason:    EventReasonChartUpdateAvailable,
+        message: fmt.Sprintf("Chart %s can be updated from %s to %s",
+            chartName, currentVersion, latestVersion),
+    }
+}
+
+func deprecatedChartEvent(rel *release.Release, key, chartName, currentVersion string) releaseEvent {
+    return releaseEvent{
+        key:       key,
+        release:   rel,
+        eventType: corev1.EventTypeWarning,
+        reason:    EventReasonDeprecatedChart,
+        message:   fmt.Sprintf("Chart %s %s is deprecated in its repository", chartName, currentVersion),
+    }
+}
+
+func releaseFailedEvent(rel *release.Release, key string) releaseEvent {
+    message := fmt.Sprintf("Release revision %d is %s", rel.Version, rel.Info.Status)
+    if rel.Info.Description != "" {
+        message += ": " + rel.Info.Description
+    }
+    return releaseEvent{
+        key:       key,
+        release:   rel,
+        eventType: corev1.EventTypeWarning,
+        reason:    EventReasonReleaseFailed,
+        message:   message,
+    }
+}
+
+func autoUpgradedEvent(rel *release.Release, key, chartName, previousVersion, policy string) releaseEvent {
+    return releaseEvent{
+        key:       key,
+        release:   rel,
+        eventType: corev1.EventTypeNormal,
+        reason:    EventReasonAutoUpgraded,
+        message: fmt.Sprintf("Chart %s was upgraded from %s to %s by policy %s",
+            chartName, previousVersion, rel.Chart.Metadata.Version, policy),
+    }
+}
+
+func autoUpgradeFailedEvent(rel *release.Release, key, chartName, latestVersion, policy, reason string, outcome upgradeOutcome) releaseEvent {
+    result := "failed"
+    switch outcome {
+    case upgradeRolledBack:
+        result = "failed and was rolled back"
+    case upgradeRollbackFailed:
+        result = "failed and so did the rollback"
+    }
+    return releaseEvent{
+        key:       key,
+        release:   rel,
+        eventType: corev1.EventTypeWarning,
+        reason:    EventReasonAutoUpgradeFailed,
+        message: fmt.Sprintf("Upgrade of chart %s from %s to %s by policy %s %s: %s",
+            chartName, rel.Chart.Metadata.Version, latestVersion, policy, result, reason),
+    }
+}
+
+// recordEvents creates an event in the release namespace for each finding
+// that does not have one yet.
+func (m *Monitor) recordEvents(events []releaseEvent) {
+    if !eventsEnabled() || len(events) == 0 {
+        return
+    }
+
+    recorded := 0
+    for _, e := range events {
+        name := eventName(e.release, e.key)
+        client := m.client.CoreV1().Events(e.release.Namespace)
+        if _, err := client.Get(context.TODO(), name, metav1.GetOptions{}); err == nil {
+            continue
+        } else if !apierrors.IsNotFound(err) {
+            m.log.Warnf("Failed to get event %s in namespace: %s: %v", name, e.release.Namespace, err)
+            continue
+        }
+
+        now := time.Now()
+        event := &corev1.Event{
+            ObjectMeta: metav1.ObjectMeta{
+                Name:      name,
+                Namespace: e.release.Namespace,
+                Labels:    map[string]string{"app": "helm-monitor"},
+            },
+            InvolvedObject:      storageObject(e.release),
+            Reason:              e.reason,
+            Message:             e.message,
+            Type:                e.eventType,
+            Source:              corev1.EventSource{Component: eventComponent},
+            FirstTimestamp:      metav1.NewTime(now),
+            LastTimestamp:       metav1.NewTime(now),
+            Count:               1,
+            ReportingController: "helm-monitor.io/" + eventComponent,
+            ReportingInstance:   leaderIdentity(),
+        }
+        if _, err := client.Create(context.TODO(), event, metav1.CreateOptions{}); err != nil && !apierrors.IsAlreadyExists(err) {
+            m.log.Warnf("Failed to record %s event for helm release %s in namespace: %s: %v",
+                e.reason, e.release.Name, e.release.Namespace, err)
+            continue
+        }
+        recorded++
+    }
+    m.log.Debugf("Recorded %d new Kubernetes events", recorded)
+}
@@ -0,0 +1,229 @@
+package helm
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+)
+
+const (
+    defaultGitHubAPIURL = "https://api.github.com"
+    defaultGitLabAPIURL = "https://gitlab.com/api/v4"
+)
+
+// PullRequest proposes merging a pushed branch into the base branch.
+type PullRequest struct {
+    Title string
+    Body  string
+    Head  string // branch with the change
+    Base  string
+}
+
+// Forge opens pull requests on the hosting service of the GitOps repository.
+// Both methods return the web URL of the pull request.
+type Forge interface {
+    // FindPullRequest returns the pull request for the branch, or "". Merged
+    // and closed pull requests count too, so a declined update is not
+    // proposed again.
+    FindPullRequest(head string) (string, error)
+    CreatePullRequest(pr PullRequest) (string, error)
+}
+
+func newForge(config ForgeConfig, token string) (Forge, error) {
+    if config.Repository == "" {
+        return nil, fmt.Errorf("forge repository is required")
+    }
+    client := &forgeClient{
+        baseURL:    strings.TrimSuffix(config.URL, "/"),
+        httpClient: &http.Client{Timeout: 30 * time.Second},
+    }
+
+    switch strings.ToLower(config.Type) {
+    case "github":
+        if client.baseURL == "" {
+            client.baseURL = defaultGitHubAPIURL
+        }
+        client.header, client.token = "Authorization", "Bearer "+token
+        return &gitHubForge{client: client, repository: config.Repository}, nil
+    case "gitlab":
+        if client.baseURL == "" {
+            client.baseURL = defaultGitLabAPIURL
+        }
+        client.header, client.token = "PRIVATE-TOKEN", token
+        return &gitLabForge{client: client, project: url.PathEscape(config.Repository)}, nil
+    case "gitea":
+        if client.baseURL == "" {
+            return nil, fmt.Errorf("forge url is required for gitea, e.g. https://gitea.example.com/api/v1")
+        }
+        client.header, client.token = "Authorization", "token "+token
+        return &giteaForge{client: client, repository: config.Repository}, nil
+    default:
+        return nil, fmt.Errorf("invalid forge type '%s', expected github, gitlab or gitea", config.Type)
+    }
+}
+
+// forgeClient calls the JSON API of a forge.
+type forgeClient struct {
+    baseURL    string
+    header     string
+    token      string
+    httpClient *http.Client
+}
+
+func (c *forgeClient) do(method, path string, body, out interface{}) error {
+    var reader io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return fmt.Errorf("failed to encode request: %v", err)
+        }
+        reader = bytes.NewReader(data)
+    }
+
+    req, err := http.NewRequest(method, c.baseURL+path, reader)
+    if err != nil {
+        return fmt.Errorf("failed to create request: %v", err)
+    }
+    req.Header.Set("Accept", "application/json")
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    req.Header.Set(c.header, c.token)
+
+    resp, err := c.httpClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("failed to call %s %s: %v", method, path, err)
+    }
+    defer resp.Body.Close()
+
+    data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+    if err != nil {
+        return fmt.Errorf("failed to read response of %s %s: %v", method, path, err)
+    }
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, truncateText(strings.TrimSpace(string(data)), 300))
+    }
+    if out != nil {
+        if err := json.Unmarshal(data, out); err != nil {
+            return fmt.Errorf("failed to decode response of %s %s: %v", method, path, err)
+        }
+    }
+    return nil
+}
+
+type gitHubForge struct {
+    client     *forgeClient
+    repository string // owner/name
+}
+
+type gitHubPullRequest struct {
+    HTMLURL string `json:"html_url"`
+}
+
+func (f *gitHubForge) FindPullRequest(head string) (string, error) {
+    owner := strings.SplitN(f.repository, "/", 2)[0]
+    var pulls []gitHubPullRequest
+    path := fmt.Sprintf("/repos/%s/pulls?state=all&head=%s", f.repository, url.QueryEscape(owner+":"+head))
+    if err := f.client.do(http.MethodGet, path, nil, &pulls); err != nil {
+        return "", err
+    }
+    if len(pulls) == 0 {
+        return "", nil
+    }
+    return pulls[0].HTMLURL, nil
+}
+
+func (f *gitHubForge) CreatePullRequest(pr PullRequest) (string, error) {
+    var created gitHubPullRequest
+    err := f.client.do(http.MethodPost, fmt.Sprintf("/repos/%s/pulls", f.repository), map[string]string{
+        "title": pr.Title,
+        "body":  pr.Body,
+        "head":  pr.Head,
+        "base":  pr.Base,
+    }, &created)
+    return created.HTMLURL, err
+}
+
+type gitLabForge struct {
+    client  *forgeClient
+    project string // URL encoded project path or ID
+}
+
+type gitLabMergeRequest struct {
+    WebURL string `json:"web_url"`
+}
+
+func (f *gitLabForge) FindPullRequest(head string) (string, error) {
+    var requests []gitLabMergeRequest
+    path := fmt.Sprintf("/projects/%s/merge_requests?state=all&source_branch=%s", f.project, url.QueryEscape(head))
+    if err := f.client.do(http.MethodGet, path, nil, &requests); err != nil {
+        return "", err
+    }
+    if len(requests) == 0 {
+        return "", nil
+    }
+    return requests[0].WebURL, nil
+}
+
+func (f *gitLabForge) CreatePullRequest(pr PullRequest) (string, error) {
+    var created gitLabMergeRequest
+    err := f.client.do(http.MethodPost, fmt.Sprintf("/projects/%s/merge_requests", f.project), map[string]string{
+        "title":         pr.Title,
+        "description":   pr.Body,
+        "source_branch": pr.Head,
+        "target_branch": pr.Base,
+    }, &created)
+    return created.WebURL, err
+}
+
+type giteaForge struct {
+    client     *forgeClient
+    repository string // owner/name
+}
+
+type giteaPullRequest struct {
+    HTMLURL string `json:"html_url"`
+    Head    struct {
+        Ref string `json:"ref"`
+    } `json:"head"`
+}
+
+// FindPullRequest lists the pull requests, since Gitea cannot filter them
+// by head branch. It pages until an empty page, the server may return fewer
+// pull requests per page than asked for.
+func (f *giteaForge) FindPullRequest(head string) (string, error) {
+    previous := ""
+    for page := 1; ; page++ {
+        var pulls []giteaPullRequest
+        path := fmt.Sprintf("/repos/%s/pulls?state=all&limit=50&page=%d", f.repository, page)
+        if err := f.client.do(http.MethodGet, path, nil, &pulls); err != nil {
+            return "", err
+        }
+        // A server ignoring the page would return the first one forever
+        if len(pulls) == 0 || pulls[0].HTMLURL == previous {
+            return "", nil
+        }
+        previous = pulls[0].HTMLURL
+        for _, pr := range pulls {
+            if pr.Head.Ref == head {
+                return pr.HTMLURL, nil
+            }
+        }
+    }
+}
+
+func (f *giteaForge) CreatePullRequest(pr PullRequest) (string, error) {
+    var created giteaPullRequest
+    err := f.client.do(http.MethodPost, fmt.Sprintf("/repos/%s/pulls", f.repository), map[string]string{
+        "title": pr.Title,
+        "body":  pr.Body,
+        "head":  pr.Head,
+        "base":  pr.Base,
+    }, &created)
+    return created.HTMLURL, err
+}
@@ -0,0 +1,522 @@
+package helm
+
+import (
+    "bytes"
+    "fmt"
+    "io/fs"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "gopkg.in/yaml.v3"
+)
+
+type ForgeConfig struct {
+    Type       string `yaml:"type"`       // github, gitlab or gitea
+    URL        string `yaml:"url"`        // API base URL, defaults to the public GitHub or GitLab API
+    Repository string `yaml:"repository"` // owner/name, or the GitLab project path
+}
+
+type GitOpsConfig struct {
+    Enabled      bool        `yaml:"enabled"`
+    Checkout     string      `yaml:"checkout"`      // local clone used only by helm-monitor
+    Remote       string      `yaml:"remote"`        // defaults to origin
+    BaseBranch   string      `yaml:"base_branch"`   // defaults to main
+    BranchPrefix string      `yaml:"branch_prefix"` // defaults to helm-monitor/
+    Paths        []string    `yaml:"paths"`         // directories searched for manifests, the whole checkout when empty
+    AuthorName   string      `yaml:"author_name"`
+    AuthorEmail  string      `yaml:"author_email"`
+    Forge        ForgeConfig `yaml:"forge"`
+}
+
+// gitopsUpdate is a new chart version for a release that may be declared in
+// the GitOps repository.
+type gitopsUpdate struct {
+    namespace      string
+    release        string
+    chart          string
+    currentVersion string
+    latestVersion  string
+    bump           string
+}
+
+// manifestDoc is one YAML document of the checkout.
+type manifestDoc struct {
+    path string // relative to the checkout
+    root *yaml.Node
+}
+
+// versionRef is a version field that pins the installed chart version.
+type versionRef struct {
+    path string
+    kind string
+    node *yaml.Node
+}
+
+// gitopsSession proposes the updates of one check. The checkout is reset to
+// the base branch once, every proposal branches off it.
+type gitopsSession struct {
+    m      *Monitor
+    config GitOpsConfig
+    git    *gitCheckout
+    forge  Forge
+    docs   []manifestDoc
+    files  map[string][]byte
+}
+
+type gitCheckout struct {
+    dir string
+    env []string
+}
+
+var branchNameRegex = regexp.MustCompile(`[^A-Za-z0-9._/-]+`)
+
+func (c *GitOpsConfig) setDefaults() {
+    if c.Remote == "" {
+        c.Remote = "origin"
+    }
+    if c.BaseBranch == "" {
+        c.BaseBranch = "main"
+    }
+    if c.BranchPrefix == "" {
+        c.BranchPrefix = "helm-monitor/"
+    }
+    if c.AuthorName == "" {
+        c.AuthorName = "helm-monitor"
+    }
+    if c.AuthorEmail == "" {
+        c.AuthorEmail = "helm-monitor@localhost"
+    }
+}
+
+// validateGitOpsConfig reports invalid GitOps settings when the
+// configuration is loaded.
+func validateGitOpsConfig(config GitOpsConfig) []string {
+    if !config.Enabled {
+        return nil
+    }
+    var errs []string
+    if config.Checkout == "" {
+        errs = append(errs, "GitOps checkout is required")
+    }
+    if _, err := newForge(config.Forge, ""); err != nil {
+        errs = append(errs, fmt.Sprintf("GitOps forge is invalid: %v", err))
+    }
+    if os.Getenv("GITOPS_TOKEN") == "" {
+        errs = append(errs, "GITOPS_TOKEN is required when GitOps is enabled")
+    }
+    return errs
+}
+
+func (g *gitCheckout) run(args ...string) (string, error) {
+    cmd := exec.Command("git", append([]string{"-C", g.dir}, args...)...)
+    cmd.Env = append(os.Environ(), g.env...)
+    out, err := cmd.CombinedOutput()
+    if err != nil {
+        return "", fmt.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+    }
+    return strings.TrimSpace(string(out)), nil
+}
+
+// newGitOpsSession fetches the remote, resets the checkout to the base
+// branch and parses its manifests. It returns nil when GitOps is disabled.
+func (m *Monitor) newGitOpsSession() (*gitopsSession, error) {
+    config := m.config.GitOps
+    if !config.Enabled {
+        return nil, nil
+    }
+    config.setDefaults()
+
+    forge, err := newForge(config.Forge, os.Getenv("GITOPS_TOKEN"))
+    if err != nil {
+        return nil, err
+    }
+
+    s := &gitopsSession{
+        m:      m,
+        config: config,
+        forge:  forge,
+        files:  make(map[string][]byte),
+        git: &gitCheckout{dir: config.Checkout, env: []string{
+            "GIT_AUTHOR_NAME=" + config.AuthorName,
+            "GIT_AUTHOR_EMAIL=" + config.AuthorEmail,
+            "GIT_COMMITTER_NAME=" + config.AuthorName,
+            "GIT_COMMITTER_EMAIL=" + config.AuthorEmail,
+            "GIT_TERMINAL_PROMPT=0",
+        }},
+    }
+    if _, err := s.git.run("fetch", "--prune", config.Remote); err != nil {
+        return nil, err
+    }
+    if err := s.resetToBase(); err != nil {
+        return nil, err
+    }
+    if err := s.scan(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+func (s *gitopsSession) baseRef() string {
+    return s.config.Remote + "/" + s.config.BaseBranch
+}
+
+// resetToBase discards whatever a previous proposal left in the checkout.
+func (s *gitopsSession) resetToBase() error {
+    _, err := s.git.run("checkout", "--force", "--detach", s.baseRef())
+    return err
+}
+
+func (s *gitopsSession) scan() error {
+    roots := s.config.Paths
+    if len(roots) == 0 {
+        roots = []string{"."}
+    }
+    for _, root := range roots {
+        err := filepath.WalkDir(filepath.Join(s.config.Checkout, root), func(path string, d fs.DirEntry, err error) error {
+            if err != nil {
+                return err
+            }
+            if d.IsDir() {
+                if d.Name() == ".git" {
+                    return filepath.SkipDir
+                }
+                return nil
+            }
+            if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+                return nil
+            }
+
+            data, err := os.ReadFile(path)
+            if err != nil {
+                return err
+            }
+            rel, err := filepath.Rel(s.config.Checkout, path)
+            if err != nil {
+                return err
+            }
+            s.files[rel] = data
+
+            decoder := yaml.NewDecoder(bytes.NewReader(data))
+            for {
+                var doc yaml.Node
+                // Stops at the end and at documents that are not plain
+                // YAML, like helmfile templates
+                if err := decoder.Decode(&doc); err != nil {
+                    break
+                }
+                if len(doc.Content) > 0 {
+                    s.docs = append(s.docs, manifestDoc{path: rel, root: doc.Content[0]})
+                }
+            }
+            return nil
+        })
+        if err != nil {
+            return fmt.Errorf("failed to read manifests in %s: %v", root, err)
+        }
+    }
+    s.m.log.Debugf("Found %d YAML documents in GitOps checkout %s", len(s.docs), s.config.Checkout)
+    return nil
+}
+
+// mapValue follows keys through nested mappings.
+func mapValue(node *yaml.Node, keys ...string) *yaml.Node {
+    for _, key := range keys {
+        if node == nil || node.Kind != yaml.MappingNode {
+            return nil
+        }
+        var next *yaml.Node
+        for i := 0; i+1 < len(node.Content); i += 2 {
+            if node.Content[i].Value == key {
+                next = node.Content[i+1]
+                break
+            }
+        }
+        node = next
+    }
+    return node
+}
+
+func scalarValue(node *yaml.Node, keys ...string) string {
+    if v := mapValue(node, keys...); v != nil && v.Kind == yaml.ScalarNode {
+        return v.Value
+    }
+    return ""
+}
+
+// matches reports whether a declaration is the release. Declarations without
+// a namespace match any, it is often set by kustomize.
+func (u gitopsUpdate) matches(name, namespace, chartName string) bool {
+    return name == u.release && (namespace == "" || namespace == u.namespace) && chartName == u.chart
+}
+
+// fluxVersionRefs finds the chart version of a Flux HelmRelease.
+func fluxVersionRefs(doc *yaml.Node, u gitopsUpdate) []*yaml.Node {
+    if scalarValue(doc, "kind") != "HelmRelease" || !strings.HasPrefix(scalarValue(doc, "apiVersion"), "helm.toolkit.fluxcd.io/") {
+        return nil
+    }
+    // Flux names releases [targetNamespace-]name unless releaseName is set
+    name := scalarValue(doc, "spec", "releaseName")
+    if name == "" {
+        name = scalarValue(doc, "metadata", "name")
+        if target := scalarValue(doc, "spec", "targetNamespace"); target != "" {
+            name = target + "-" + name
+        }
+    }
+    namespace := scalarValue(doc, "spec", "storageNamespace")
+    if namespace == "" {
+        namespace = scalarValue(doc, "metadata", "namespace")
+    }
+    if !u.matches(name, namespace, scalarValue(doc, "spec", "chart", "spec", "chart")) {
+        return nil
+    }
+    return []*yaml.Node{mapValue(doc, "spec", "chart", "spec", "version")}
+}
+
+// argoVersionRefs finds the target revision of the Helm sources of an Argo
+// CD Application.
+func argoVersionRefs(doc *yaml.Node, u gitopsUpdate) []*yaml.Node {
+    if scalarValue(doc, "kind") != "Application" || !strings.HasPrefix(scalarValue(doc, "apiVersion"), "argoproj.io/") {
+        return nil
+    }
+    sources := []*yaml.Node{mapValue(doc, "spec", "source")}
+    if list := mapValue(doc, "spec", "sources"); list != nil && list.Kind == yaml.SequenceNode {
+        sources = append(sources, list.Content...)
+    }
+
+    namespace := scalarValue(doc, "spec", "destination", "namespace")
+    var refs []*yaml.Node
+    for _, source := range sources {
+        if source == nil {
+            continue
+        }
+        name := scalarValue(source, "helm", "releaseName")
+        if name == "" {
+            name = scalarValue(doc, "metadata", "name")
+        }
+        if u.matches(name, namespace, scalarValue(source, "chart")) {
+            refs = append(refs, mapValue(source, "targetRevision"))
+        }
+    }
+    return refs
+}
+
+// helmfileVersionRefs finds the versions of the releases of a helmfile.
+func helmfileVersionRefs(doc *yaml.Node, u gitopsUpdate) []*yaml.Node {
+    releases := mapValue(doc, "releases")
+    if releases == nil || releases.Kind != yaml.SequenceNode {
+        return nil
+    }
+    var refs []*yaml.Node
+    for _, r := range releases.Content {
+        // Charts are referenced as repo/chart, a path or an OCI URL
+        chartRef := scalarValue(r, "chart")
+        chartName := chartRef[strings.LastIndex(chartRef, "/")+1:]
+        if u.matches(scalarValue(r, "name"), scalarValue(r, "namespace"), chartName) {
+            refs = append(refs, mapValue(r, "version"))
+        }
+    }
+    return refs
+}
+
+// versionRefs returns the version fields pinning the installed version of
+// the release. Ranges and other versions are left alone.
+func (s *gitopsSession) versionRefs(u gitopsUpdate) []versionRef {
+    finders := []struct {
+        kind string
+        find func(*yaml.Node, gitopsUpdate) []*yaml.Node
+    }{
+        {"HelmRelease", fluxVersionRefs},
+        {"Application", argoVersionRefs},
+        {"helmfile", helmfileVersionRefs},
+    }
+
+    var refs []versionRef
+    for _, doc := range s.docs {
+        for _, finder := range finders {
+            for _, node := range finder.find(doc.root, u) {
+                if node == nil || node.Kind != yaml.ScalarNode {
+                    continue
+                }
+                if strings.TrimPrefix(node.Value, "v") != strings.TrimPrefix(u.currentVersion, "v") {
+                    s.m.log.Debugf("Version %s of helm release %s in %s does not pin the installed version %s, skipping",
+                        node.Value, u.release, doc.path, u.currentVersion)
+                    continue
+                }
+                refs = append(refs, versionRef{path: doc.path, kind: finder.kind, node: node})
+            }
+        }
+    }
+    return refs
+}
+
+// replaceScalar rewrites the value of a scalar in place, keeping the quotes,
+// comments and formatting of the rest of the file.
+func replaceScalar(data []byte, node *yaml.Node, value string) ([]byte, error) {
+    lines := strings.SplitAfter(string(data), "\n")
+    if node.Line < 1 || node.Line > len(lines) {
+        return nil, fmt.Errorf("line %d out of range", node.Line)
+    }
+    line := []rune(lines[node.Line-1])
+    start := node.Column - 1
+    if start >= 0 && start < len(line) && (line[start] == '"' || line[start] == '\'') {
+        start++
+    }
+    old := []rune(node.Value)
+    if start < 0 || start+len(old) > len(line) || string(line[start:start+len(old)]) != node.Value {
+        return nil, fmt.Errorf("unexpected value at line %d, column %d", node.Line, node.Column)
+    }
+    lines[node.Line-1] = string(line[:start]) + value + string(line[start+len(old):])
+    return []byte(strings.Join(lines, "")), nil
+}
+
+func (s *gitopsSession) branchName(u gitopsUpdate) string {
+    name := fmt.Sprintf("%s%s/%s-%s", s.config.BranchPrefix, u.namespace, u.release, u.latestVersion)
+    return branchNameRegex.ReplaceAllString(name, "-")
+}
+
+func (s *gitopsSession) pullRequest(u gitopsUpdate, branch string, refs []versionRef) PullRequest {
+    body := fmt.Sprintf("helm-monitor found a new version of chart `%s` for Helm release `%s` in namespace `%s`: `%s` -> `%s` (%s).\n\nUpdated:\n",
+        u.chart, u.release, u.namespace, u.currentVersion, u.latestVersion, u.bump)
+    for _, ref := range refs {
+        body += fmt.Sprintf("- `%s` (%s, line %d)\n", ref.path, ref.kind, ref.node.Line)
+    }
+    return PullRequest{
+        Title: fmt.Sprintf("Update %s to %s in %s/%s", u.chart, u.latestVersion, u.namespace, u.release),
+        Body:  body,
+        Head:  branch,
+        Base:  s.config.BaseBranch,
+    }
+}
+
+// propose edits the version fields of the release on a new branch, pushes it
+// and opens a pull request. It returns the pull request URL, or "" when the
+// release is not declared in the repository. Branches are named after the
+// release and version, so later checks find the existing pull request, even
+// once it was merged or closed.
+func (s *gitopsSession) propose(u gitopsUpdate) (string, error) {
+    branch := s.branchName(u)
+    if url, ok := s.m.proposals[branch]; ok {
+        return url, nil
+    }
+
+    refs := s.versionRefs(u)
+    if len(refs) == 0 {
+        return "", nil
+    }
+
+    url, err := s.forge.FindPullRequest(branch)
+    if err != nil {
+        return "", err
+    }
+    if url != "" {
+        s.remember(branch, url)
+        return url, nil
+    }
+
+    // A branch pushed before may still lack its pull request
+    if _, err := s.git.run("rev-parse", "--verify", "--quiet", "refs/remotes/"+s.config.Remote+"/"+branch); err != nil {
+        if err := s.commit(u, branch, refs); err != nil {
+            return "", err
+        }
+        if _, err := s.git.run("push", s.config.Remote, branch+":refs/heads/"+branch); err != nil {
+            return "", err
+        }
+    }
+    url, err = s.forge.CreatePullRequest(s.pullRequest(u, branch, refs))
+    if err != nil {
+        return "", err
+    }
+    s.remember(branch, url)
+    return url, nil
+}
+
+func (s *gitopsSession) remember(branch, url string) {
+    if s.m.proposals == nil {
+        s.m.proposals = make(map[string]string)
+    }
+    s.m.proposals[branch] = url
+}
+
+// commit creates the branch from the base branch with the edited files, and
+// resets the checkout afterwards.
+func (s *gitopsSession) commit(u gitopsUpdate, branch string, refs []versionRef) error {
+    defer func() {
+        if err := s.resetToBase(); err != nil {
+            s.m.log.Errorf("Failed to reset GitOps checkout: %v", err)
+        }
+    }()
+
+    if _, err := s.git.run("checkout", "--force", "-B", branch, s.baseRef()); err != nil {
+        return err
+    }
+
+    edited := make(map[string][]byte)
+    // Later lines first, so earlier edits do not move them
+    sort.Slice(refs, func(i, j int) bool { return refs[i].node.Line > refs[j].node.Line })
+    for _, ref := range refs {
+        data, ok := edited[ref.path]
+        if !ok {
+            data = s.files[ref.path]
+        }
+        value := u.latestVersion
+        if strings.HasPrefix(ref.node.Value, "v") && !strings.HasPrefix(value, "v") {
+            value = "v" + value
+        }
+        updated, err := replaceScalar(data, ref.node, value)
+        if err != nil {
+            return fmt.Errorf("failed to update %s: %v", ref.path, err)
+        }
+        edited[ref.path] = updated
+    }
+
+    var paths []string
+    for path, data := range edited {
+        if err := os.WriteFile(filepath.Join(s.config.Checkout, path), data, 0o644); err != nil {
+            return fmt.Errorf("failed to write %s: %v", path, err)
+        }
+        paths = append(paths, path)
+    }
+    sort.Strings(paths)
+
+    if _, err := s.git.run(append([]string{"add", "--"}, paths...)...); err != nil {
+        return err
+    }
+    message := fmt.Sprintf("Update %s to %s in %s/%s", u.chart, u.latestVersion, u.namespace, u.release)
+    _, err := s.git.run("commit", "--quiet", "-m", message)
+    return err
+}
+
+// proposeUpdates opens pull requests for the updates declared in the GitOps
+// repository and returns their URLs by namespace/name.
+func (m *Monitor) proposeUpdates(updates []gitopsUpdate) map[string]string {
+    if len(updates) == 0 {
+        return nil
+    }
+    session, err := m.newGitOpsSession()
+    if err != nil {
+        m.log.Errorf("Skipping GitOps pull requests: %v", err)
+        return nil
+    }
+    if session == nil {
+        return nil
+    }
+
+    urls := make(map[string]string)
+    for _, u := range updates {
+        url, err := session.propose(u)
+        if err != nil {
+            m.log.Errorf("Failed to open pull request for helm release %s in namespace: %s: %v", u.release, u.namespace, err)
+            continue
+        }
+        if url == "" {
+            m.log.Debugf("Helm release %s in namespace: %s is not declared in the GitOps repository", u.release, u.namespace)
+            continue
+        }
+        m.log.Infof("Pull request for helm release %s in namespace: %s to chart %s: %s", u.release, u.namespace, u.latestVersion, url)
+        urls[u.namespace+"/"+u.release] = url
+    }
+    return urls
+}
@@ -0,0 +1,322 @@
+package helm
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+
+    "github.com/sirupsen/logrus"
+)
+
+const (
+    testFluxManifest = `apiVersion: helm.toolkit.fluxcd.io/v2beta2
+kind: HelmRelease
+metadata:
+  name: podinfo
+  namespace: apps
+spec:
+  chart:
+    spec:
+      chart: podinfo
+      # pinned until the next review
+      version: "6.4.0"
+`
+    testArgoManifest = `apiVersion: argoproj.io/v1alpha1
+kind: Application
+metadata:
+  name: grafana
+spec:
+  destination:
+    namespace: monitoring
+  source:
+    chart: grafana
+    repoURL: https://grafana.github.io/helm-charts
+    targetRevision: 7.0.0
+`
+    testHelmfile = `releases:
+  - name: redis
+    namespace: cache
+    chart: bitnami/redis
+    version: v18.1.0
+  - name: redis
+    namespace: other
+    chart: bitnami/redis
+    version: v18.1.0
+`
+)
+
+var testGitOpsUpdates = []gitopsUpdate{
+    {namespace: "apps", release: "podinfo", chart: "podinfo", currentVersion: "6.4.0", latestVersion: "6.5.0", bump: "minor"},
+    {namespace: "monitoring", release: "grafana", chart: "grafana", currentVersion: "7.0.0", latestVersion: "7.0.1", bump: "patch"},
+    {namespace: "cache", release: "redis", chart: "redis", currentVersion: "18.1.0", latestVersion: "18.2.0", bump: "minor"},
+    // Not declared in the repository
+    {namespace: "apps", release: "missing", chart: "missing", currentVersion: "1.0.0", latestVersion: "1.1.0", bump: "minor"},
+}
+
+// git runs git in dir and fails the test on errors.
+func git(t *testing.T, dir string, args ...string) string {
+    t.Helper()
+    cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+    cmd.Env = append(os.Environ(),
+        "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@localhost",
+        "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@localhost",
+        "GIT_CONFIG_NOSYSTEM=1", "HOME="+dir,
+    )
+    out, err := cmd.CombinedOutput()
+    if err != nil {
+        t.Fatalf("git %s failed: %v: %s", strings.Join(args, " "), err, out)
+    }
+    return strings.TrimSpace(string(out))
+}
+
+// newTestGitOpsRepo creates a bare remote with the manifests on main and
+// returns it with a clone for helm-monitor.
+func newTestGitOpsRepo(t *testing.T) (string, string) {
+    if _, err := exec.LookPath("git"); err != nil {
+        t.Skip("git is not installed")
+    }
+    dir := t.TempDir()
+    remote := filepath.Join(dir, "remote.git")
+    seed := filepath.Join(dir, "seed")
+    checkout := filepath.Join(dir, "checkout")
+
+    git(t, dir, "init", "--quiet", "--bare", remote)
+    git(t, dir, "clone", "--quiet", remote, seed)
+    files := map[string]string{
+        "clusters/prod/podinfo.yaml": testFluxManifest,
+        "clusters/prod/grafana.yml":  testArgoManifest,
+        "helmfile.yaml":              testHelmfile,
+    }
+    for path, content := range files {
+        path = filepath.Join(seed, path)
+        if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+    git(t, seed, "add", ".")
+    git(t, seed, "commit", "--quiet", "-m", "Add releases")
+    git(t, seed, "push", "--quiet", "origin", "HEAD:refs/heads/main")
+    git(t, dir, "clone", "--quiet", remote, checkout)
+    return remote, checkout
+}
+
+// fakeForgePageSize caps the Gitea pages, like its MAX_RESPONSE_ITEMS.
+const fakeForgePageSize = 30
+
+// fakeForge implements the pull request endpoints of GitHub, GitLab and
+// Gitea that helm-monitor uses.
+type fakeForge struct {
+    t     *testing.T
+    kind  string
+    mu    sync.Mutex
+    pulls []map[string]string
+}
+
+// newFakeForge starts with closed pull requests of other branches, more than
+// ten pages of them on Gitea.
+func newFakeForge(t *testing.T, kind string) *fakeForge {
+    f := &fakeForge{t: t, kind: kind}
+    for i := 1; i <= 10*fakeForgePageSize+5; i++ {
+        f.pulls = append(f.pulls, map[string]string{
+            "head": fmt.Sprintf("feature-%d", i),
+            "base": "main",
+            "url":  fmt.Sprintf("https://forge.example.com/pulls/%d", i),
+        })
+    }
+    return f
+}
+
+func (f *fakeForge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    header, token, path := "Authorization", "Bearer secret", "/repos/example/gitops/pulls"
+    switch f.kind {
+    case "gitlab":
+        header, token, path = "PRIVATE-TOKEN", "secret", "/projects/example%2Fgitops/merge_requests"
+    case "gitea":
+        token = "token secret"
+    }
+    if r.Header.Get(header) != token {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    if r.URL.EscapedPath() != path {
+        http.NotFound(w, r)
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        if state := r.URL.Query().Get("state"); state != "all" {
+            f.t.Errorf("pull requests listed with state %q, want all", state)
+        }
+        head := r.URL.Query().Get("source_branch")
+        if f.kind == "github" {
+            head = strings.TrimPrefix(r.URL.Query().Get("head"), "example:")
+        }
+        pulls := f.pulls
+        if f.kind == "gitea" {
+            // Oldest first, so the pull requests of helm-monitor are on the
+            // last page
+            page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+            start, end := (page-1)*fakeForgePageSize, page*fakeForgePageSize
+            if start < 0 || start > len(pulls) {
+                start = len(pulls)
+            }
+            if end > len(pulls) {
+                end = len(pulls)
+            }
+            pulls = pulls[start:end]
+        }
+        list := []map[string]interface{}{}
+        for _, pr := range pulls {
+            if head == "" || pr["head"] == head {
+                list = append(list, map[string]interface{}{
+                    "html_url": pr["url"],
+                    "web_url":  pr["url"],
+                    "head":     map[string]string{"ref": pr["head"]},
+                })
+            }
+        }
+        json.NewEncoder(w).Encode(list)
+    case http.MethodPost:
+        var body map[string]string
+        if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        pr := map[string]string{"title": body["title"], "head": body["head"], "base": body["base"]}
+        if f.kind == "gitlab" {
+            pr["head"], pr["base"] = body["source_branch"], body["target_branch"]
+        }
+        pr["url"] = fmt.Sprintf("https://forge.example.com/pulls/%d", len(f.pulls)+1)
+        f.pulls = append(f.pulls, pr)
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(map[string]string{"html_url": pr["url"], "web_url": pr["url"]})
+    default:
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func newTestGitOpsMonitor(checkout, forgeType, forgeURL string) *Monitor {
+    log := logrus.New()
+    log.SetOutput(io.Discard)
+    return &Monitor{log: log, config: &Config{GitOps: GitOpsConfig{
+        Enabled:  true,
+        Checkout: checkout,
+        Forge:    ForgeConfig{Type: forgeType, URL: forgeURL, Repository: "example/gitops"},
+    }}}
+}
+
+func TestProposeUpdates(t *testing.T) {
+    t.Setenv("GITOPS_TOKEN", "secret")
+
+    for _, kind := range []string{"github", "gitlab", "gitea"} {
+        t.Run(kind, func(t *testing.T) {
+            remote, checkout := newTestGitOpsRepo(t)
+            forge := newFakeForge(t, kind)
+            existing := len(forge.pulls)
+            server := httptest.NewServer(forge)
+            defer server.Close()
+
+            m := newTestGitOpsMonitor(checkout, kind, server.URL)
+            urls := m.proposeUpdates(testGitOpsUpdates)
+
+            want := map[string]string{
+                "apps/podinfo":       fmt.Sprintf("https://forge.example.com/pulls/%d", existing+1),
+                "monitoring/grafana": fmt.Sprintf("https://forge.example.com/pulls/%d", existing+2),
+                "cache/redis":        fmt.Sprintf("https://forge.example.com/pulls/%d", existing+3),
+            }
+            if len(urls) != len(want) {
+                t.Fatalf("got pull requests %v, want %v", urls, want)
+            }
+            for release, url := range want {
+                if urls[release] != url {
+                    t.Errorf("pull request of %s is %q, want %q", release, urls[release], url)
+                }
+            }
+
+            edits := []struct {
+                branch string
+                path   string
+                line   string
+            }{
+                {"helm-monitor/apps/podinfo-6.5.0", "clusters/prod/podinfo.yaml", `      version: "6.5.0"`},
+                {"helm-monitor/monitoring/grafana-7.0.1", "clusters/prod/grafana.yml", `    targetRevision: 7.0.1`},
+                {"helm-monitor/cache/redis-18.2.0", "helmfile.yaml", `    version: v18.2.0`},
+            }
+            for i, edit := range edits {
+                pr := forge.pulls[existing+i]
+                if pr["head"] != edit.branch || pr["base"] != "main" {
+                    t.Errorf("pull request %d merges %s into %s, want %s into main", i+1, pr["head"], pr["base"], edit.branch)
+                }
+
+                content := git(t, remote, "show", "refs/heads/"+edit.branch+":"+edit.path)
+                if !strings.Contains(content+"\n", "\n"+edit.line+"\n") {
+                    t.Errorf("%s on pushed branch %s lacks %q:\n%s", edit.path, edit.branch, edit.line, content)
+                }
+                changed := git(t, remote, "diff", "--name-only", "main", "refs/heads/"+edit.branch)
+                if changed != edit.path {
+                    t.Errorf("branch %s changed %q, want only %s", edit.branch, changed, edit.path)
+                }
+            }
+            if title := forge.pulls[existing]["title"]; title != "Update podinfo to 6.5.0 in apps/podinfo" {
+                t.Errorf("unexpected pull request title %q", title)
+            }
+
+            // Comments and the other release of the files are left alone
+            podinfo := git(t, remote, "show", "refs/heads/"+edits[0].branch+":"+edits[0].path)
+            if !strings.Contains(podinfo, "# pinned until the next review") {
+                t.Errorf("comment was dropped:\n%s", podinfo)
+            }
+            helmfile := git(t, remote, "show", "refs/heads/"+edits[2].branch+":helmfile.yaml")
+            if strings.Count(helmfile, "version: v18.1.0") != 1 {
+                t.Errorf("release of the other namespace was updated:\n%s", helmfile)
+            }
+
+            // A restarted replica finds the pull requests, even once they
+            // were merged or closed, instead of opening new ones
+            m = newTestGitOpsMonitor(checkout, kind, server.URL)
+            again := m.proposeUpdates(testGitOpsUpdates)
+            if created := len(forge.pulls) - existing; created != 3 {
+                t.Errorf("got %d pull requests after the second check, want 3", created)
+            }
+            for release, url := range want {
+                if again[release] != url {
+                    t.Errorf("second check linked %s to %q, want %q", release, again[release], url)
+                }
+            }
+        })
+    }
+}
+
+func TestValidateGitOpsConfigRequiresToken(t *testing.T) {
+    config := GitOpsConfig{
+        Enabled:  true,
+        Checkout: "/var/lib/helm-monitor/gitops",
+        Forge:    ForgeConfig{Type: "github", Repository: "example/gitops"},
+    }
+
+    t.Setenv("GITOPS_TOKEN", "")
+    if errs := validateGitOpsConfig(config); len(errs) != 1 || !strings.Contains(errs[0], "GITOPS_TOKEN") {
+        t.Errorf("got errors %v without a token, want the missing GITOPS_TOKEN", errs)
+    }
+
+    t.Setenv("GITOPS_TOKEN", "secret")
+    if errs := validateGitOpsConfig(config); len(errs) != 0 {
+        t.Errorf("got errors %v, want none", errs)
+    }
+}
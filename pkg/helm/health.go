@@ -0,0 +1,33 @@
+package helm
+
+import (
+    "fmt"
+    "helm.sh/helm/v3/pkg/release"
+)
+
+// isUnhealthy reports whether the latest revision of a release is stuck or
+// failed. Uninstalled releases kept with --keep-history are not tracked.
+func isUnhealthy(rel *release.Release) bool {
+    if rel.Info == nil {
+        return false
+    }
+
+    switch rel.Info.Status {
+    case release.StatusDeployed, release.StatusUninstalled:
+        return false
+    default:
+        return true
+    }
+}
+
+func formatUnhealthyRelease(rel *release.Release) string {
+    msg := fmt.Sprintf("•    *release*: %s\n      *namespace*: %s\n      *status*: %s\n      *revision*: %d\n",
+        rel.Name, rel.Namespace, rel.Info.Status, rel.Version)
+    if !rel.Info.LastDeployed.IsZero() {
+        msg += fmt.Sprintf("      *last deployed*: UTC %s\n", rel.Info.LastDeployed.UTC().Format("2006-01-02 15:04:05"))
+    }
+    if rel.Info.Description != "" {
+        msg += fmt.Sprintf("      *description*: %s\n", rel.Info.Description)
+    }
+    return msg
+}
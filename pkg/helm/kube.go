@@ -0,0 +1,72 @@
+package helm
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "github.com/Masterminds/semver/v3"
+    "helm.sh/helm/v3/pkg/chartutil"
+    "helm.sh/helm/v3/pkg/repo"
+)
+
+func (m *Monitor) serverVersion() (string, error) {
+    info, err := m.client.Discovery().ServerVersion()
+    if err != nil {
+        return "", fmt.Errorf("failed to get Kubernetes server version: %v", err)
+    }
+    return info.GitVersion, nil
+}
+
+// targetKubeVersion returns the Kubernetes version set in TARGET_KUBE_VERSION,
+// normalized so that "1.30" and "v1.30.0" are equivalent.
+func targetKubeVersion() (string, error) {
+    target := strings.TrimSpace(os.Getenv("TARGET_KUBE_VERSION"))
+    if target == "" {
+        return "", nil
+    }
+
+    v, err := semver.NewVersion(target)
+    if err != nil {
+        return "", fmt.Errorf("invalid TARGET_KUBE_VERSION %q: %v", target, err)
+    }
+    return "v" + v.String(), nil
+}
+
+// kubeVersionCompatible uses the same check as helm install, so a chart is
+// only reported as incompatible when helm would refuse to install it.
+func kubeVersionCompatible(constraint, kubeVersion string) bool {
+    if constraint == "" || kubeVersion == "" {
+        return true
+    }
+    return chartutil.IsCompatibleRange(constraint, kubeVersion)
+}
+
+// newestCompatibleVersion returns the newest chart version that can be
+// installed on kubeVersion, relying on the index being sorted newest first.
+func newestCompatibleVersion(chartVersions repo.ChartVersions, kubeVersion string) *repo.ChartVersion {
+    for _, cv := range chartVersions {
+        if kubeVersionCompatible(cv.KubeVersion, kubeVersion) {
+            return cv
+        }
+    }
+    return nil
+}
+
+func formatIncompatible(kubeVersion, constraint string, compatible *repo.ChartVersion, current *semver.Version) string {
+    msg := fmt.Sprintf("      :no_entry: *not installable on Kubernetes %s*: chart requires kubeVersion %s\n", kubeVersion, constraint)
+    if compatible != nil {
+        if v, err := semver.NewVersion(compatible.Version); err == nil && v.GreaterThan(current) {
+            return msg + fmt.Sprintf("      *newest compatible version*: %s\n", compatible.Version)
+        }
+    }
+    return msg + "      *newest compatible version*: none newer than installed\n"
+}
+
+func formatUpgradeBlocker(releaseName, namespace, installedVersion, constraint string, compatible *repo.ChartVersion) string {
+    fix := "none available"
+    if compatible != nil {
+        fix = compatible.Version
+    }
+    return fmt.Sprintf("•    *release*: %s\n      *namespace*: %s\n      *installed*: %s (kubeVersion %s)\n      *newest compatible version*: %s\n",
+        releaseName, namespace, installedVersion, constraint, fix)
+}
@@ -0,0 +1,139 @@
+package helm
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/types"
+    "k8s.io/client-go/tools/leaderelection"
+    "k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+    defaultLeaseName = "helm-monitor"
+    leaseDuration    = 15 * time.Second
+    renewDeadline    = 10 * time.Second
+    retryPeriod      = 2 * time.Second
+
+    // leaderLabel marks the pod of the leader, the webhook Service selects it
+    leaderLabel = "helm-monitor.io/leader"
+)
+
+func leaderElectionEnabled() bool {
+    switch strings.ToLower(os.Getenv("LEADER_ELECTION")) {
+    case "true", "1", "yes":
+        return true
+    }
+    return false
+}
+
+func leaderIdentity() string {
+    if name := os.Getenv("POD_NAME"); name != "" {
+        return name
+    }
+    hostname, err := os.Hostname()
+    if err != nil {
+        return fmt.Sprintf("helm-monitor-%d", os.Getpid())
+    }
+    return hostname
+}
+
+// IsLeader reports whether this replica runs checks and sends notifications.
+func (m *Monitor) IsLeader() bool {
+    return m.leader.Load()
+}
+
+// labelLeader sets the leader label on the pod of this replica, so webhooks
+// are only delivered to the leader. It needs POD_NAME.
+func (m *Monitor) labelLeader(leader bool) {
+    name := os.Getenv("POD_NAME")
+    namespace := podNamespace()
+    if name == "" || namespace == "" || m.client == nil {
+        return
+    }
+    patch := fmt.Sprintf(`{"metadata":{"labels":{%q:%q}}}`, leaderLabel, strconv.FormatBool(leader))
+    _, err := m.client.CoreV1().Pods(namespace).Patch(context.TODO(), name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+    if err != nil {
+        m.log.Warnf("Failed to set label %s=%t on pod %s/%s: %v", leaderLabel, leader, namespace, name, err)
+    }
+}
+
+// Run starts the scheduled checks, only on the replica holding the
+// helm-monitor Lease when LEADER_ELECTION is enabled. Followers keep
+// campaigning until ctx is done.
+func (m *Monitor) Run(ctx context.Context) error {
+    // Every replica keeps its configuration current
+    go m.watchChartWatches(ctx)
+
+    if !leaderElectionEnabled() {
+        m.leader.Store(true)
+        m.labelLeader(true)
+        m.Start(ctx)
+        return nil
+    }
+
+    namespace := podNamespace()
+    if namespace == "" {
+        return fmt.Errorf("LEADER_ELECTION requires POD_NAMESPACE to be set")
+    }
+    name := os.Getenv("LEASE_NAME")
+    if name == "" {
+        name = defaultLeaseName
+    }
+    identity := leaderIdentity()
+
+    lock := &resourcelock.LeaseLock{
+        LeaseMeta:  metav1.ObjectMeta{Name: name, Namespace: namespace},
+        Client:     m.client.CoordinationV1(),
+        LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+    }
+
+    // The checks of a lost term finish before those of a new term start, so
+    // two loops never run in the same replica
+    var term sync.Mutex
+
+    // A replica restarted after leading must not keep receiving webhooks
+    m.labelLeader(false)
+
+    m.log.Infof("Starting leader election for Lease %s/%s as %s", namespace, name, identity)
+    for ctx.Err() == nil {
+        elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+            Lock:            lock,
+            LeaseDuration:   leaseDuration,
+            RenewDeadline:   renewDeadline,
+            RetryPeriod:     retryPeriod,
+            ReleaseOnCancel: true,
+            Name:            name,
+            Callbacks: leaderelection.LeaderCallbacks{
+                OnStartedLeading: func(leaderCtx context.Context) {
+                    term.Lock()
+                    defer term.Unlock()
+                    m.log.Info("Acquired leadership, running checks")
+                    m.leader.Store(true)
+                    m.labelLeader(true)
+                    m.Start(leaderCtx)
+                },
+                OnStoppedLeading: func() {
+                    m.leader.Store(false)
+                    m.labelLeader(false)
+                    m.log.Info("Lost leadership, serving as follower")
+                },
+                OnNewLeader: func(current string) {
+                    if current != identity {
+                        m.log.Infof("Current leader is %s", current)
+                    }
+                },
+            },
+        })
+        if err != nil {
+            return fmt.Errorf("failed to create leader elector: %v", err)
+        }
+        elector.Run(ctx)
+    }
+    return nil
+}
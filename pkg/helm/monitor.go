@@ -1,17 +1,23 @@
 package helm
 
 import (
+    "context"
     "fmt"
     "os"
     "strings"
     "runtime"
     "time"
     "regexp"
-    "strconv"
+    "sync"
+    "sync/atomic"
+    "net/url"
     "helm.sh/helm/v3/pkg/action"
+    "helm.sh/helm/v3/pkg/chart"
+    "helm.sh/helm/v3/pkg/chart/loader"
     "helm.sh/helm/v3/pkg/cli"
     "helm.sh/helm/v3/pkg/repo"
     "helm.sh/helm/v3/pkg/release"
+    "k8s.io/client-go/dynamic"
     "k8s.io/client-go/kubernetes"
     "github.com/sirupsen/logrus"
     "helm.sh/helm/v3/pkg/getter"
@@ -20,18 +26,30 @@ import (
 )
 
 const (
-    defaultCheckInterval = "6h"
+    AlertOnChartVersion = "chart_version"
+    AlertOnAppVersion   = "app_version"
+    AlertOnAny          = "any"
 )
 
-type Schedule struct {
-    interval time.Duration
-    weekday  time.Weekday
-    isWeekly bool
-}
-
 type ChartMapping struct {
     InstalledName string `yaml:"installed_name"`
     RemoteName    string `yaml:"remote_name"`
+    AlertOn       string `yaml:"alert_on"` // chart_version (default), app_version or any
+
+    // Set by ChartWatch resources, which only select releases in their own
+    // namespace, by name or by Helm release labels
+    Namespace     string            `yaml:"-"`
+    ReleaseLabels map[string]string `yaml:"-"`
+}
+
+func (c ChartMapping) matches(rel *release.Release) bool {
+    if c.Namespace != "" && c.Namespace != rel.Namespace {
+        return false
+    }
+    if c.InstalledName != "" {
+        return rel.Name == c.InstalledName
+    }
+    return len(c.ReleaseLabels) > 0 && labelsMatch(rel.Labels, c.ReleaseLabels)
 }
 
 type RepoConfig struct {
@@ -40,86 +58,61 @@ type RepoConfig struct {
     Charts map[string]ChartMapping `yaml:"charts"`
 }
 
+type RouteConfig struct {
+    Channel         string            `yaml:"channel"`
+    Namespaces      []string          `yaml:"namespaces"`
+    NamespaceLabels map[string]string `yaml:"namespace_labels"`
+    ReleasePattern  string            `yaml:"release_pattern"` // regular expression matched against the release name
+    Charts          []string          `yaml:"charts"`
+}
+
 type NotificationConfig struct {
-    Enabled bool `yaml:"enabled"`
+    Enabled        bool          `yaml:"enabled"`
+    StatusMessage  bool          `yaml:"status_message"` // keep one pinned message updated in place
+    ClusterName    string        `yaml:"cluster_name"`
+    DefaultChannel string        `yaml:"default_channel"` // defaults to SLACK_CHANNEL_ID
+    Routes         []RouteConfig `yaml:"routes"`          // the first matching route wins
+
+    // Schedule is "immediate" (default) to send new findings after every
+    // check, or a cron expression or interval to collect them into a summary
+    Schedule string `yaml:"schedule"`
+    Timezone string `yaml:"timezone"` // IANA time zone for the schedule, defaults to UTC
+
+    QuietHours []QuietHoursConfig `yaml:"quiet_hours"`
+    Freezes    []FreezeConfig     `yaml:"freezes"`
 }
 
 type Config struct {
     Repositories  []RepoConfig      `yaml:"repositories"`
     Notifications NotificationConfig `yaml:"notifications"`
+    AutoUpgrade   AutoUpgradeConfig  `yaml:"auto_upgrade"`
+    GitOps        GitOpsConfig       `yaml:"gitops"`
 }
 
 type Monitor struct {
     client       *kubernetes.Clientset
+    dynamic      dynamic.Interface
     log          *logrus.Logger
     config       *Config
+    fileConfig   *Config // repositories.yaml, merged with ChartWatches in operator mode
     notifier     *NotificationService
+    store        StateStore
+    reportStore  ReportStore // report of the last check, apart from the notification state
+    schedule     Schedule
+    leader       atomic.Bool
+    lastReport   []ReportSection // findings of the last check, partial checks update it
+    tracked      map[string]trackedChart // namespace/name of the releases checked
+    dryRuns      map[string]*dryRunResult // last upgrade dry-run per namespace/name
+    proposals    map[string]string // pull request URL per GitOps branch
+
+    // mu serializes checks started by the schedule and by held digests
+    mu           sync.Mutex
+    digestTimer  *time.Timer
+    termCtx      context.Context // ends with the leader term, set by Start
+    upgrading    sync.Mutex      // held while automatic upgrades run
 }
 
-func parseInterval(s string) (*Schedule, error) {
-    // Handle weekly format first
-    weeklyRegex := regexp.MustCompile(`^(\d+)w(?:/(\w+))?$`)
-    if matches := weeklyRegex.FindStringSubmatch(s); matches != nil {
-        weekday := time.Monday // Default to Monday if no day specified
-        if matches[2] != "" {
-            var err error
-            weekday, err = parseWeekday(matches[2])
-            if err != nil {
-                return nil, fmt.Errorf("invalid weekday: %v", err)
-            }
-        }
-        return &Schedule{
-            interval: time.Hour * 24 * 7,
-            weekday:  weekday,
-            isWeekly: true,
-        }, nil
-    }
-
-    // Handle regular intervals (minutes, hours, days)
-    value, err := parseRegularInterval(s)
-    if err != nil {
-        return nil, fmt.Errorf("invalid interval format. Valid formats: '1m', '1h', '1d', '1w', or '1w/monday' for weekly schedule")
-    }
-
-    return &Schedule{interval: value, isWeekly: false}, nil
-}
-
-func parseWeekday(day string) (time.Weekday, error) {
-    days := map[string]time.Weekday{
-        "sunday":    time.Sunday,
-        "monday":    time.Monday,
-        "tuesday":   time.Tuesday,
-        "wednesday": time.Wednesday,
-        "thursday":  time.Thursday,
-        "friday":    time.Friday,
-        "saturday":  time.Saturday,
-    }
-
-    if weekday, ok := days[strings.ToLower(day)]; ok {
-        return weekday, nil
-    }
-    return 0, fmt.Errorf("invalid weekday: %s", day)
-}
-
-func parseRegularInterval(s string) (time.Duration, error) {
-    if strings.HasSuffix(s, "d") {
-        days, err := strconv.Atoi(s[:len(s)-1])
-        if err != nil {
-            return 0, fmt.Errorf("invalid day value: %v", err)
-        }
-        return time.Hour * 24 * time.Duration(days), nil
-    }
-
-    // Handle minutes and hours directly with time.ParseDuration
-    duration, err := time.ParseDuration(s)
-    if err != nil {
-        return 0, fmt.Errorf("invalid duration: %v", err)
-    }
-
-    return duration, nil
-}
-
-func NewMonitor(client *kubernetes.Clientset, log *logrus.Logger) *Monitor {
+func NewMonitor(client *kubernetes.Clientset, dynamicClient dynamic.Interface, log *logrus.Logger) *Monitor {
     logLevel := strings.ToLower(os.Getenv("LOG_LEVEL"))
     switch logLevel {
     case "debug":
@@ -135,9 +128,18 @@ func NewMonitor(client *kubernetes.Clientset, log *logrus.Logger) *Monitor {
     }
 
     m := &Monitor{
-        client: client,
-        log:    log,
+        client:  client,
+        dynamic: dynamicClient,
+        log:     log,
     }
+
+    schedule, spec, err := loadSchedule()
+    if err != nil {
+        log.Errorf("Invalid check schedule '%s': %v", spec, err)
+        log.Infof("Using default interval: %s", defaultCheckInterval)
+        schedule, _ = parseSchedules(defaultCheckInterval, time.Local)
+    }
+    m.schedule = schedule
     
     config, err := m.loadConfig()
     if err != nil {
@@ -145,7 +147,18 @@ func NewMonitor(client *kubernetes.Clientset, log *logrus.Logger) *Monitor {
         return m
     }
     m.config = config
-    m.notifier = NewNotificationService(config.Notifications)
+    m.fileConfig = config
+
+    store, err := NewStateStore(client)
+    if err != nil {
+        log.Errorf("Failed to create state store: %v", err)
+        return m
+    }
+    m.store = store
+    if m.reportStore, err = NewReportStore(client); err != nil {
+        log.Errorf("Failed to create report store: %v", err)
+    }
+    m.notifier = NewNotificationService(config.Notifications, store, client)
     
     return m
 }
@@ -155,6 +168,11 @@ func (m *Monitor) loadConfig() (*Config, error) {
     configPath := "/etc/helm-tracker/repositories.yaml"
     
     if _, err := os.Stat(configPath); os.IsNotExist(err) {
+        // ChartWatch resources can provide the whole configuration
+        if operatorMode() {
+            m.log.Infof("No config file at %s, using ChartWatch resources only", configPath)
+            return &Config{}, nil
+        }
         return nil, fmt.Errorf("config file does not exist at %s", configPath)
     }
     
@@ -192,6 +210,36 @@ func (m *Monitor) loadConfig() (*Config, error) {
         }
     }
 
+    for _, repo := range config.Repositories {
+        for _, chart := range repo.Charts {
+            switch chart.AlertOn {
+            case "", AlertOnChartVersion, AlertOnAppVersion, AlertOnAny:
+            default:
+                duplicateErrors = append(duplicateErrors,
+                    fmt.Sprintf("Chart installation name '%s' has invalid alert_on '%s', expected %s, %s or %s",
+                        chart.InstalledName, chart.AlertOn, AlertOnChartVersion, AlertOnAppVersion, AlertOnAny))
+            }
+        }
+    }
+
+    for i, route := range config.Notifications.Routes {
+        if route.Channel == "" {
+            duplicateErrors = append(duplicateErrors, fmt.Sprintf("Notification route %d has no channel", i+1))
+        }
+        if _, err := regexp.Compile(route.ReleasePattern); err != nil {
+            duplicateErrors = append(duplicateErrors,
+                fmt.Sprintf("Notification route %d has invalid release_pattern '%s': %v", i+1, route.ReleasePattern, err))
+        }
+    }
+
+    if _, err := parseNotificationSchedule(config.Notifications); err != nil {
+        duplicateErrors = append(duplicateErrors, fmt.Sprintf("Notification schedule is invalid: %v", err))
+    }
+
+    duplicateErrors = append(duplicateErrors, validateQuietConfig(config.Notifications)...)
+    duplicateErrors = append(duplicateErrors, validateAutoUpgradeConfig(config.AutoUpgrade)...)
+    duplicateErrors = append(duplicateErrors, validateGitOpsConfig(config.GitOps)...)
+
     for name, repos := range chartInstalls {
         if len(repos) > 1 {
             duplicateErrors = append(duplicateErrors, 
@@ -201,7 +249,7 @@ func (m *Monitor) loadConfig() (*Config, error) {
     }
 
     if len(duplicateErrors) > 0 {
-        return nil, fmt.Errorf("Configuration error - found duplications:\n%s", 
+        return nil, fmt.Errorf("Configuration error - found invalid or duplicated entries:\n%s", 
             strings.Join(duplicateErrors, "\n"))
     }
 
@@ -209,83 +257,134 @@ func (m *Monitor) loadConfig() (*Config, error) {
     return &config, nil
 }
 
-func (m *Monitor) Start() {
-    intervalStr := os.Getenv("CHECK_INTERVAL")
-    if intervalStr == "" {
-        intervalStr = defaultCheckInterval
-        m.log.Infof("No CHECK_INTERVAL specified, using default: %s", defaultCheckInterval)
-    }
+// Start runs checks on the schedule until ctx is done.
+func (m *Monitor) Start(ctx context.Context) {
+    m.log.Infof("Starting helm-monitor with check schedule: %s", m.schedule)
+    defer m.stopDigest()
 
-    schedule, err := parseInterval(intervalStr)
-    if err != nil {
-        m.log.Errorf("Invalid check interval '%s': %v", intervalStr, err)
-        m.log.Info("Using default interval: 6h")
-        schedule, _ = parseInterval(defaultCheckInterval)
-    }
+    m.mu.Lock()
+    m.termCtx = ctx
+    m.mu.Unlock()
 
-    m.log.Infof("Starting helm-monitor with check interval: %s", intervalStr)
+    // Releases changed and charts published between scheduled checks are
+    // checked right away
+    go m.watchReleases(ctx)
+    go m.watchRepositories(ctx)
     
     for {
         m.CheckUpdates()
         
         // Calculate next check time
-        nextCheckTime := time.Now().Add(schedule.interval)
-        if schedule.isWeekly {
-            nextCheckTime = m.nextWeekday(time.Now(), schedule.weekday)
-        }
+        nextCheckTime := m.schedule.Next(time.Now())
         
         m.log.Info("========================================")
         m.log.Info("Helm release check completed")
-        m.log.Infof("Next check scheduled for: %s", nextCheckTime.Format("2006-01-02 15:04:05"))
+        m.log.Infof("Next check scheduled for: %s", nextCheckTime.Format("2006-01-02 15:04:05 MST"))
         m.log.Info("========================================")
 
         // Sleep until next check
-        if schedule.isWeekly {
-            time.Sleep(time.Until(nextCheckTime))
-        } else {
-            time.Sleep(schedule.interval)
+        select {
+        case <-ctx.Done():
+            m.log.Info("Stopping scheduled checks")
+            return
+        case <-time.After(time.Until(nextCheckTime)):
         }
     }
 }
 
-func (m *Monitor) nextWeekday(now time.Time, weekday time.Weekday) time.Time {
-    daysUntil := int(weekday - now.Weekday())
-    if daysUntil <= 0 {
-        daysUntil += 7
-    }
-    nextRun := now.Add(time.Hour * 24 * time.Duration(daysUntil))
-    return time.Date(nextRun.Year(), nextRun.Month(), nextRun.Day(), 0, 0, 0, 0, now.Location())
-}
-
-func (m *Monitor) findChartInfo(releaseName string) (string, string) {
+func (m *Monitor) findChartInfo(rel *release.Release) (string, ChartMapping) {
     if m.config == nil {
         m.log.Error("Configuration not loaded")
-        return "", ""
+        return "", ChartMapping{}
     }
 
-    m.log.Debugf("Looking for repository for release: %s", releaseName)
+    m.log.Debugf("Looking for repository for release: %s", rel.Name)
     
     for _, repo := range m.config.Repositories {
         for _, chartMapping := range repo.Charts {
-            if releaseName == chartMapping.InstalledName {
+            if chartMapping.matches(rel) {
                 m.log.Debugf("Found matching repository %s for release %s, remote chart name: %s", 
-                    repo.URL, releaseName, chartMapping.RemoteName)
-                return repo.URL, chartMapping.RemoteName
+                    repo.URL, rel.Name, chartMapping.RemoteName)
+                return repo.URL, chartMapping
             }
         }
     }
     
-    return "", ""
+    return "", ChartMapping{}
+}
+
+type LatestVersion struct {
+    Chart              *repo.ChartVersion
+    Versions           repo.ChartVersions
+    Deprecated         bool // the chart is marked deprecated in the repository
+    InstalledAvailable bool // the installed version is still published in the repository
+}
+
+func (m *Monitor) getLatestVersion(repoURL, chartName, installedVersion string) (*LatestVersion, error) {
+    chartVersions, err := m.getChartVersions(repoURL, chartName)
+    if err != nil {
+        return nil, err
+    }
+
+    // Helm treats a chart as deprecated when its latest version says so
+    latest := &LatestVersion{
+        Chart:      chartVersions[0],
+        Versions:   chartVersions,
+        Deprecated: chartVersions[0].Deprecated,
+    }
+
+    installed, err := semver.NewVersion(installedVersion)
+    for _, cv := range chartVersions {
+        if cv.Version == installedVersion {
+            latest.InstalledAvailable = true
+            break
+        }
+        if v, verr := semver.NewVersion(cv.Version); err == nil && verr == nil && v.Equal(installed) {
+            latest.InstalledAvailable = true
+            break
+        }
+    }
+
+    return latest, nil
+}
+
+// appVersionNewer compares app versions as semver when possible. Many charts
+// use non-semver app versions, which are then compared for inequality only.
+func appVersionNewer(current, latest string) bool {
+    if latest == "" || current == latest {
+        return false
+    }
+
+    currentVer, err := semver.NewVersion(current)
+    if err != nil {
+        return true
+    }
+    latestVer, err := semver.NewVersion(latest)
+    if err != nil {
+        return true
+    }
+    return latestVer.GreaterThan(currentVer)
+}
+
+func shouldAlert(alertOn string, chartUpdated, appUpdated bool) bool {
+    switch alertOn {
+    case AlertOnAppVersion:
+        return appUpdated
+    case AlertOnAny:
+        return chartUpdated || appUpdated
+    default:
+        return chartUpdated
+    }
 }
 
-func (m *Monitor) getLatestVersion(repoURL, chartName string) (string, error) {
-    m.log.Debugf("Getting latest version for chart %s from repository %s", chartName, repoURL)
+func (m *Monitor) getChartVersions(repoURL, chartName string) (repo.ChartVersions, error) {
+    m.log.Debugf("Getting chart versions for chart %s from repository %s", chartName, repoURL)
     
     settings := cli.New()
     
     tempDir, err := os.MkdirTemp("", "helm-cache-*")
     if err != nil {
-        return "", fmt.Errorf("failed to create temp directory: %v", err)
+        return nil, fmt.Errorf("failed to create temp directory: %v", err)
     }
     defer os.RemoveAll(tempDir)
     
@@ -298,48 +397,117 @@ func (m *Monitor) getLatestVersion(repoURL, chartName string) (string, error) {
 
     chartRepository, err := repo.NewChartRepository(&chartRepo, getter.All(settings))
     if err != nil {
-        return "", fmt.Errorf("failed to create chart repository: %v", err)
+        return nil, fmt.Errorf("failed to create chart repository: %v", err)
     }
 
     index, err := chartRepository.DownloadIndexFile()
     if err != nil {
-        return "", fmt.Errorf("failed to download repository index: %v", err)
+        return nil, fmt.Errorf("failed to download repository index: %v", err)
     }
     defer os.Remove(index)
 
     indexFile, err := repo.LoadIndexFile(index)
     if err != nil {
-        return "", fmt.Errorf("failed to load index file: %v", err)
+        return nil, fmt.Errorf("failed to load index file: %v", err)
     }
 
     chartVersions, ok := indexFile.Entries[chartName]
     if !ok {
-        return "", fmt.Errorf("chart %s not found in repository", chartName)
+        return nil, fmt.Errorf("chart %s not found in repository", chartName)
     }
 
     if len(chartVersions) == 0 {
-        return "", fmt.Errorf("no versions found for chart %s", chartName)
+        return nil, fmt.Errorf("no versions found for chart %s", chartName)
     }
 
-    latestVersion := chartVersions[0].Version
-    return latestVersion, nil
+    return chartVersions, nil
 }
 
-func (m *Monitor) CheckUpdates() {
-    m.log.Debug("Starting CheckUpdates")
-    
-    // Get the check interval from environment
-    intervalStr := os.Getenv("CHECK_INTERVAL")
-    if intervalStr == "" {
-        intervalStr = defaultCheckInterval
-        m.log.Infof("No CHECK_INTERVAL specified, using default: %s", defaultCheckInterval)
+func (m *Monitor) downloadChart(repoURL string, chartVersion *repo.ChartVersion) (*chart.Chart, error) {
+    if len(chartVersion.URLs) == 0 {
+        return nil, fmt.Errorf("chart %s version %s has no downloadable URLs", chartVersion.Name, chartVersion.Version)
+    }
+
+    chartURL, err := repo.ResolveReferenceURL(repoURL, chartVersion.URLs[0])
+    if err != nil {
+        return nil, fmt.Errorf("failed to resolve chart URL: %v", err)
+    }
+    m.log.Debugf("Downloading chart %s version %s from %s", chartVersion.Name, chartVersion.Version, chartURL)
+
+    u, err := url.Parse(chartURL)
+    if err != nil {
+        return nil, fmt.Errorf("failed to parse chart URL: %v", err)
+    }
+
+    g, err := getter.All(cli.New()).ByScheme(u.Scheme)
+    if err != nil {
+        return nil, fmt.Errorf("failed to get getter for scheme %s: %v", u.Scheme, err)
     }
 
-    schedule, err := parseInterval(intervalStr)
+    data, err := g.Get(chartURL, getter.WithURL(repoURL))
     if err != nil {
-        m.log.Errorf("Invalid check interval '%s': %v", intervalStr, err)
-        m.log.Info("Using default interval: 6h")
-        schedule, _ = parseInterval(defaultCheckInterval)
+        return nil, fmt.Errorf("failed to download chart: %v", err)
+    }
+
+    chrt, err := loader.LoadArchive(data)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load chart archive: %v", err)
+    }
+
+    return chrt, nil
+}
+
+// CheckUpdates checks all tracked releases.
+func (m *Monitor) CheckUpdates() {
+    m.checkReleases(nil)
+}
+
+// CheckRelease checks one release and updates its findings in the report of
+// the last check.
+func (m *Monitor) CheckRelease(namespace, name string) {
+    m.checkReleases(func(ns, n string) bool {
+        return ns == namespace && n == name
+    })
+}
+
+// checkReleases checks the tracked releases selected by match, or all of them
+// when match is nil, and starts the automatic upgrades the check queued.
+func (m *Monitor) checkReleases(match func(namespace, name string) bool) {
+    pending := m.check(match)
+    if len(pending) == 0 {
+        return
+    }
+
+    m.mu.Lock()
+    ctx := m.termCtx
+    m.mu.Unlock()
+    if ctx == nil {
+        return
+    }
+    go m.runUpgrades(ctx, pending)
+}
+
+// check runs one check and returns the automatic upgrades it queued. The
+// findings of a partial check replace those of the same releases in the last
+// report, so notifications and reports always see the whole fleet.
+func (m *Monitor) check(match func(namespace, name string) bool) []pendingUpgrade {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if match != nil && m.lastReport == nil {
+        m.log.Debug("No complete check yet, checking all releases")
+        match = nil
+    }
+    if match == nil {
+        m.log.Debug("Starting CheckUpdates")
+        m.tracked = make(map[string]trackedChart)
+    } else {
+        m.log.Debug("Starting partial CheckUpdates")
+        for key := range m.tracked {
+            if parts := strings.SplitN(key, "/", 2); match(parts[0], parts[1]) {
+                delete(m.tracked, key)
+            }
+        }
     }
 
     settings := cli.New()
@@ -347,36 +515,80 @@ func (m *Monitor) CheckUpdates() {
     actionConfig := new(action.Configuration)
     if err := actionConfig.Init(settings.RESTClientGetter(), "", "", m.log.Printf); err != nil {
         m.log.Errorf("Failed to init action config: %v", err)
-        return
+        return nil
     }
 
-    configuredReleases := make(map[string]struct{})
-    for _, repo := range m.config.Repositories {
-        for _, chartMapping := range repo.Charts {
-            configuredReleases[chartMapping.InstalledName] = struct{}{}
-        }
+    if m.config == nil {
+        m.log.Error("Configuration not loaded, skipping check")
+        return nil
     }
 
     batchSize := 5
     client := action.NewList(actionConfig)
     client.AllNamespaces = true
+    // Include failed and pending releases, the list only returns the latest revision of each
+    client.All = true
+    client.SetStateMask()
     
     releases, err := client.Run()
     if err != nil {
         m.log.Errorf("Failed to list releases: %v", err)
-        return
+        return nil
     }
 
     var releaseQueue []*release.Release
-    for _, release := range releases {
-        if _, exists := configuredReleases[release.Name]; exists {
-            releaseQueue = append(releaseQueue, release)
+    var unhealthy []ReportItem
+    var events []releaseEvent
+    resolver := m.newOwnerResolver()
+    owners := make(map[string]string)
+    for _, rel := range releases {
+        if match != nil && !match(rel.Namespace, rel.Name) {
+            continue
+        }
+        if repository, _ := m.findChartInfo(rel); repository == "" {
+            continue
+        }
+        if owner := resolver.owner(rel); owner != "" {
+            owners[rel.Namespace+"/"+rel.Name] = owner
+        }
+        if isUnhealthy(rel) {
+            m.log.Warnf("Helm release %s in namespace: %s is in state %s at revision %d: %s",
+                rel.Name, rel.Namespace, rel.Info.Status, rel.Version, rel.Info.Description)
+            _, chartMapping := m.findChartInfo(rel)
+            item := newReportItem("health", rel.Namespace, rel.Name, chartMapping.RemoteName,
+                fmt.Sprintf("%d/%s", rel.Version, rel.Info.Status), formatUnhealthyRelease(rel))
+            unhealthy = append(unhealthy, item)
+            if rel.Info.Status == release.StatusFailed {
+                events = append(events, releaseFailedEvent(rel, item.Key))
+            }
+        }
+        if rel.Info != nil && rel.Info.Status == release.StatusUninstalled {
+            continue
         }
+        releaseQueue = append(releaseQueue, rel)
     }
     releases = nil
     runtime.GC()
 
-    var updates []string
+    kubeVersion, err := m.serverVersion()
+    if err != nil {
+        m.log.Warnf("Skipping Kubernetes compatibility checks: %v", err)
+    }
+
+    targetVersion, err := targetKubeVersion()
+    if err != nil {
+        m.log.Errorf("Skipping target Kubernetes version checks: %v", err)
+    }
+
+    var updates []ReportItem
+    var blockers []ReportItem
+    var apiReports []ReportItem
+    var deprecatedCharts []ReportItem
+    var vanishedVersions []ReportItem
+    reports := make(map[string]*releaseReport)
+    skipped := make(map[string]bool) // releases whose repository lookup failed
+    upgrades := m.newUpgrader()
+    var proposals []gitopsUpdate
     for i := 0; i < len(releaseQueue); i += batchSize {
         end := i + batchSize
         if end > len(releaseQueue) {
@@ -385,57 +597,270 @@ func (m *Monitor) CheckUpdates() {
         
         batch := releaseQueue[i:end]
         for _, release := range batch {
-            repository, remoteChartName := m.findChartInfo(release.Name)
+            repository, chartMapping := m.findChartInfo(release)
+            remoteChartName := chartMapping.RemoteName
             if repository == "" || remoteChartName == "" {
                 continue
             }
 
+            report := newReleaseReport(release, repository, remoteChartName)
+            reports[release.Namespace+"/"+release.Name] = report
+            m.tracked[release.Namespace+"/"+release.Name] = trackedChart{repository: repository, chart: remoteChartName}
+
+            // Deprecated APIs of the installed manifest are reported even
+            // when the chart repository cannot tell about newer versions
+            apiFindings, apiCheckVersion := m.checkDeprecatedAPIs(release, kubeVersion, targetVersion)
+            reportAPIs := func(fixedBy string) {
+                if len(apiFindings) == 0 {
+                    return
+                }
+                apiReports = append(apiReports, newReportItem("deprecated-api", release.Namespace, release.Name,
+                    remoteChartName, fmt.Sprintf("%d/%s", release.Version, targetVersion),
+                    formatAPIReport(release.Name, release.Namespace, apiFindings, fixedBy)))
+            }
+
             currentVersion := release.Chart.Metadata.Version
-            latestVersion, err := m.getLatestVersion(repository, remoteChartName)
+            latestInfo, err := m.getLatestVersion(repository, remoteChartName, currentVersion)
             if err != nil {
                 m.log.Errorf("Failed to get latest version for %s: %v", remoteChartName, err)
+                skipped[release.Namespace+"/"+release.Name] = true
+                reportAPIs(fmt.Sprintf("unknown, failed to look up the latest version in %s", repository))
                 continue
             }
+            chartVersions := latestInfo.Versions
+            latestVersion := latestInfo.Chart.Version
+
+            if latestInfo.Deprecated {
+                m.log.Warnf("Chart %s used by helm release %s in namespace: %s is deprecated",
+                    remoteChartName, release.Name, release.Namespace)
+                item := newReportItem("deprecated-chart", release.Namespace, release.Name,
+                    remoteChartName, latestVersion,
+                    formatDeprecatedChart(release.Name, release.Namespace, remoteChartName, currentVersion, latestInfo.Chart))
+                deprecatedCharts = append(deprecatedCharts, item)
+                events = append(events, deprecatedChartEvent(release, item.Key, remoteChartName, currentVersion))
+            }
+            if !latestInfo.InstalledAvailable {
+                m.log.Warnf("Installed version %s of chart %s for helm release %s in namespace: %s no longer exists in %s",
+                    currentVersion, remoteChartName, release.Name, release.Namespace, repository)
+                vanishedVersions = append(vanishedVersions, newReportItem("missing-version", release.Namespace, release.Name,
+                    remoteChartName, currentVersion,
+                    formatVanishedVersion(release.Name, release.Namespace, remoteChartName, currentVersion, repository)))
+            }
+
+            var latestChart *chart.Chart
+            var latestChartErr error
+            getLatestChart := func() (*chart.Chart, error) {
+                if latestChart == nil && latestChartErr == nil {
+                    latestChart, latestChartErr = m.downloadChart(repository, chartVersions[0])
+                }
+                return latestChart, latestChartErr
+            }
 
             current, err := semver.NewVersion(currentVersion)
             if err != nil {
                 m.log.Errorf("Failed to parse current version %s: %v", currentVersion, err)
+                reportAPIs(fmt.Sprintf("unknown, installed version %s is not semver", currentVersion))
                 continue
             }
 
             latest, err := semver.NewVersion(latestVersion)
             if err != nil {
                 m.log.Errorf("Failed to parse latest version %s: %v", latestVersion, err)
+                reportAPIs(fmt.Sprintf("unknown, latest version %s is not semver", latestVersion))
                 continue
             }
 
-            if latest.GreaterThan(current) {
+            currentAppVersion := release.Chart.Metadata.AppVersion
+            latestAppVersion := latestInfo.Chart.AppVersion
+            report.status.LatestVersion = latestVersion
+            report.status.LatestAppVersion = latestAppVersion
+            report.status.Bump = bumpLevel(current, latest)
+            chartUpdated := latest.GreaterThan(current)
+            appUpdated := appVersionNewer(currentAppVersion, latestAppVersion)
+
+            if shouldAlert(chartMapping.AlertOn, chartUpdated, appUpdated) {
+                queuedBy := ""
                 updateMsg := fmt.Sprintf("•    *release*: %s\n      *namespace*: %s\n      *installed*: %s\n      *latest in remote repo*: %s\n",
                     release.Name, 
                     release.Namespace, 
                     currentVersion, 
                     latestVersion)
-                updates = append(updates, updateMsg)
+                if currentAppVersion != "" || latestAppVersion != "" {
+                    updateMsg += fmt.Sprintf("      *app version*: %s -> %s\n", currentAppVersion, latestAppVersion)
+                }
+
+                if !kubeVersionCompatible(chartVersions[0].KubeVersion, kubeVersion) {
+                    compatible := newestCompatibleVersion(chartVersions, kubeVersion)
+                    m.log.Warnf("Latest chart %s %s for release %s requires kubeVersion %s, cluster runs %s",
+                        remoteChartName, latestVersion, release.Name, chartVersions[0].KubeVersion, kubeVersion)
+                    updateMsg += formatIncompatible(kubeVersion, chartVersions[0].KubeVersion, compatible, current)
+                }
+
+                latestChart, err := getLatestChart()
+                if err != nil {
+                    m.log.Warnf("Failed to download latest chart for %s, skipping values diff: %v", release.Name, err)
+                } else {
+                    diff := diffValues(release.Chart.Values, latestChart.Values, release.Config)
+                    m.logValuesDiff(release.Name, diff)
+                    updateMsg += diff.format()
+
+                    if err := validateValuesSchema(latestChart, release.Config); err != nil {
+                        m.log.Warnf("Values of release %s do not validate against the schema of chart %s %s: %v",
+                            release.Name, remoteChartName, latestVersion, err)
+                        updateMsg += formatSchemaViolations(err)
+                    }
+
+                    if chartUpdated && upgradeDryRunEnabled() {
+                        result := m.upgradeDryRun(release, latestChart)
+                        updateMsg += result.format()
+                        report.status.UpgradeDryRun = result.status()
+                    }
+
+                    // Releases failing the dry-run are left for a person to upgrade
+                    if upgrades != nil && chartUpdated && report.status.UpgradeDryRun != "failed" {
+                        queuedBy = upgrades.queue(release, remoteChartName, latestChart, report.status.Bump,
+                            owners[release.Namespace+"/"+release.Name])
+                        if queuedBy != "" {
+                            updateMsg += fmt.Sprintf("      *automatic upgrade*: queued by policy %s\n", queuedBy)
+                        }
+                    }
+                }
+                item := newReportItem("update", release.Namespace, release.Name,
+                    remoteChartName, latestVersion, updateMsg)
+                updates = append(updates, item)
+                events = append(events, updateEvent(release, item.Key, remoteChartName, currentVersion, latestVersion))
+                if chartUpdated && queuedBy == "" {
+                    proposals = append(proposals, gitopsUpdate{
+                        namespace:      release.Namespace,
+                        release:        release.Name,
+                        chart:          remoteChartName,
+                        currentVersion: currentVersion,
+                        latestVersion:  latestVersion,
+                        bump:           report.status.Bump,
+                    })
+                }
                 
-                m.log.Infof("Update available for helm release: %s in namespace: %s, current version: %s, latest version: %s",
-                    release.Name, release.Namespace, currentVersion, latestVersion)
+                m.log.Infof("Update available for helm release: %s in namespace: %s, current version: %s (app %s), latest version: %s (app %s), owner: %s",
+                    release.Name, release.Namespace, currentVersion, currentAppVersion, latestVersion, latestAppVersion,
+                    owners[release.Namespace+"/"+release.Name])
             } else {
-                m.log.Infof("Helm release %s in namespace: %s is up to date version: %s",
-                    release.Name, release.Namespace, currentVersion)
+                m.log.Infof("Helm release %s in namespace: %s is up to date version: %s (app %s)",
+                    release.Name, release.Namespace, currentVersion, currentAppVersion)
+            }
+
+            if len(apiFindings) > 0 {
+                reportAPIs(m.apisFixedBy(release, latestVersion, chartUpdated,
+                    getLatestChart, apiFindings, apiCheckVersion))
+            }
+
+            if targetVersion != "" && !kubeVersionCompatible(release.Chart.Metadata.KubeVersion, targetVersion) {
+                compatible := newestCompatibleVersion(chartVersions, targetVersion)
+                m.log.Warnf("Helm release %s in namespace: %s blocks upgrade to Kubernetes %s: installed chart requires kubeVersion %s",
+                    release.Name, release.Namespace, targetVersion, release.Chart.Metadata.KubeVersion)
+                blockers = append(blockers, newReportItem("kube-blocker", release.Namespace, release.Name,
+                    remoteChartName, targetVersion+"/"+currentVersion,
+                    formatUpgradeBlocker(release.Name, release.Namespace, currentVersion, release.Chart.Metadata.KubeVersion, compatible)))
             }
 
             runtime.GC()
         }
     }
 
-    // Send notifications if there are any updates
-    if len(updates) > 0 {
-        if err := m.notifier.SendSlackNotification(updates, schedule.interval); err != nil {
+    // Updates declared in git are proposed as pull requests
+    if urls := m.proposeUpdates(proposals); len(urls) > 0 {
+        for i := range updates {
+            if url := urls[updates[i].Namespace+"/"+updates[i].Release]; url != "" {
+                updates[i].Text += fmt.Sprintf("      *pull request*: %s\n", url)
+            }
+        }
+    }
+
+    sections := []ReportSection{
+        {Title: "Helm Chart Updates Available", Items: updates},
+    }
+    sections = append(sections,
+        ReportSection{Title: "Unhealthy Releases", Items: unhealthy},
+        ReportSection{Title: "Deprecated Charts", Items: deprecatedCharts},
+        ReportSection{Title: "Installed Versions Missing From Repository", Items: vanishedVersions},
+        ReportSection{Title: "Deprecated Kubernetes APIs", Items: apiReports},
+    )
+    if targetVersion != "" {
+        sections = append(sections, ReportSection{
+            Title: fmt.Sprintf("Charts Blocking Kubernetes %s Upgrade", targetVersion),
+            Items: blockers,
+        })
+    }
+
+    for i := range sections {
+        for j := range sections[i].Items {
+            item := &sections[i].Items[j]
+            item.Owner = owners[item.Namespace+"/"+item.Release]
+        }
+    }
+
+    if match != nil {
+        sections = mergeReport(m.lastReport, sections, match)
+    }
+    m.lastReport = sections
+
+    m.recordEvents(events)
+    addFindings(reports, sections)
+    m.publishReports(reports, match == nil)
+
+    // A check that outlived the lease leaves the shared report and the
+    // notifications to the new leader, which runs its own check
+    if !m.leader.Load() {
+        m.log.Info("Leadership lost during the check, skipping report and notifications")
+        return nil
+    }
+
+    // Followers serve the report of the last check from the shared state
+    if err := m.saveReport(sections); err != nil {
+        m.log.Errorf("Failed to save report: %v", err)
+    }
+
+    // Always notify, so resolved findings are forgotten and the status message stays current
+    if m.notifier != nil {
+        if err := m.notifier.SendSlackNotification(sections, skipped); err != nil {
             if strings.HasPrefix(err.Error(), "NOTIFICATION_SKIPPED:") {
                 m.log.Info(strings.TrimPrefix(err.Error(), "NOTIFICATION_SKIPPED: "))
             } else {
                 m.log.Errorf("Failed to send Slack notification: %v", err)
             }
         }
+
+        // Deliver held findings on time when the next check runs later
+        if until := m.notifier.HeldUntil(); !until.IsZero() && until.Before(m.schedule.Next(time.Now())) {
+            m.scheduleDigest(until)
+        }
+    }
+
+    if upgrades == nil {
+        return nil
+    }
+    return upgrades.pending
+}
+
+// scheduleDigest runs a check right after quiet hours, a freeze or the wait
+// for the notification schedule end, so held findings are delivered without
+// waiting for the next scheduled check.
+func (m *Monitor) scheduleDigest(until time.Time) {
+    if m.digestTimer != nil {
+        m.digestTimer.Stop()
+    }
+    m.log.Infof("Held findings will be sent after UTC %s", until.UTC().Format("2006-01-02 15:04:05"))
+    m.digestTimer = time.AfterFunc(time.Until(until)+time.Minute, func() {
+        if m.leader.Load() {
+            m.CheckUpdates()
+        }
+    })
+}
+
+func (m *Monitor) stopDigest() {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.digestTimer != nil {
+        m.digestTimer.Stop()
+        m.digestTimer = nil
     }
 }
\ No newline at end of file
@@ -1,160 +1,417 @@
 package helm
 
 import (
-    "bytes"
-    "encoding/json"
     "fmt"
-    "net/http"
     "os"
     "strings"
     "time"
-    "strconv"
+    "helm.sh/helm/v3/pkg/repo"
+    "k8s.io/client-go/kubernetes"
 )
 
 type SlackMessage struct {
+    Text      string       `json:"text"`
+    Channel   string       `json:"channel"`
+    Timestamp string       `json:"ts,omitempty"`
+    ThreadTS  string       `json:"thread_ts,omitempty"`
+    Blocks    []SlackBlock `json:"blocks,omitempty"`
+}
+
+type ReportItem struct {
+    Key       string `json:"key"` // identifies the finding across checks
+    Namespace string `json:"namespace"`
+    Release   string `json:"release"`
+    Chart     string `json:"chart,omitempty"`
+    Owner     string `json:"owner,omitempty"` // raw value of the helm-monitor.io/owner label or annotation
     Text      string `json:"text"`
-    Channel   string `json:"channel"`
-    Timestamp string `json:"ts,omitempty"`
 }
 
-type SlackHistoryResponse struct {
-    Ok       bool           `json:"ok"`
-    Messages []SlackMessage `json:"messages"`
-    Error    string        `json:"error,omitempty"`
+type ReportSection struct {
+    Title string       `json:"title"`
+    Items []ReportItem `json:"items"`
+}
+
+func findingKey(kind, namespace, releaseName, detail string) string {
+    return fmt.Sprintf("%s/%s/%s/%s", kind, namespace, releaseName, detail)
+}
+
+// keyRelease returns the namespace/name of the release a finding key
+// belongs to.
+func keyRelease(key string) string {
+    parts := strings.SplitN(key, "/", 4)
+    if len(parts) < 3 {
+        return ""
+    }
+    return parts[1] + "/" + parts[2]
+}
+
+func newReportItem(kind, namespace, releaseName, chartName, detail, text string) ReportItem {
+    return ReportItem{
+        Key:       findingKey(kind, namespace, releaseName, detail),
+        Namespace: namespace,
+        Release:   releaseName,
+        Chart:     chartName,
+        Text:      text,
+    }
+}
+
+// mergeReport replaces the findings of the releases selected by match in
+// previous with those of a partial check.
+func mergeReport(previous, partial []ReportSection, match func(namespace, name string) bool) []ReportSection {
+    var merged []ReportSection
+    seen := make(map[string]bool)
+    for _, section := range previous {
+        out := ReportSection{Title: section.Title}
+        for _, item := range section.Items {
+            if !match(item.Namespace, item.Release) {
+                out.Items = append(out.Items, item)
+            }
+        }
+        for _, p := range partial {
+            if p.Title == section.Title {
+                out.Items = append(out.Items, p.Items...)
+            }
+        }
+        seen[section.Title] = true
+        merged = append(merged, out)
+    }
+    for _, p := range partial {
+        if !seen[p.Title] {
+            merged = append(merged, p)
+        }
+    }
+    return merged
+}
+
+func hasFindings(sections []ReportSection) bool {
+    for _, section := range sections {
+        if len(section.Items) > 0 {
+            return true
+        }
+    }
+    return false
 }
 
 type NotificationService struct {
     enabled     bool
     channelID   string
     botToken    string
+    store       StateStore
+    slack       *slackClient
+    router      *router
+    quiet       *quietSchedule
+    schedule    Schedule // nil sends new findings after every check
+    heldUntil   time.Time
+
+    statusMessage bool
+    clusterName   string
 }
 
-func NewNotificationService(config NotificationConfig) *NotificationService {
+func NewNotificationService(config NotificationConfig, store StateStore, client kubernetes.Interface) *NotificationService {
+    clusterName := config.ClusterName
+    if clusterName == "" {
+        clusterName = "cluster"
+    }
+
+    // Invalid schedules are reported by loadConfig
+    schedule, _ := parseNotificationSchedule(config)
+
+    channelID := config.DefaultChannel
+    if channelID == "" {
+        channelID = os.Getenv("SLACK_CHANNEL_ID")
+    }
+
     return &NotificationService{
         enabled:   config.Enabled,
-        channelID: os.Getenv("SLACK_CHANNEL_ID"),
+        channelID: channelID,
         botToken:  os.Getenv("SLACK_BOT_TOKEN"),
+        store:     store,
+        slack:     newSlackClient(os.Getenv("SLACK_BOT_TOKEN")),
+        router:    newRouter(config, channelID, client),
+        quiet:     newQuietSchedule(config),
+        schedule:  schedule,
+
+        statusMessage: config.StatusMessage,
+        clusterName:   clusterName,
     }
 }
 
-func (n *NotificationService) getLastNotificationTime() (time.Time, error) {
-    if n.channelID == "" || n.botToken == "" {
-        return time.Time{}, fmt.Errorf("SLACK_CHANNEL_ID and SLACK_BOT_TOKEN are required")
+// setRoutes replaces the notification routes, e.g. when ChartWatch
+// resources change.
+func (n *NotificationService) setRoutes(config NotificationConfig) {
+    n.router = newRouter(config, n.channelID, n.router.client)
+}
+
+// newFindings drops findings that were already announced and forgets the
+// announced findings that are no longer reported, so they are sent again if
+// they come back. Findings of the releases in skipped, which could not be
+// checked, e.g. because their repository was unreachable, are kept.
+func newFindings(sections []ReportSection, state *State, skipped map[string]bool) []ReportSection {
+    current := make(map[string]bool)
+    var fresh []ReportSection
+    for _, section := range sections {
+        var items []ReportItem
+        for _, item := range section.Items {
+            current[item.Key] = true
+            if _, announced := state.Announced[item.Key]; !announced {
+                items = append(items, item)
+            }
+        }
+        fresh = append(fresh, ReportSection{Title: section.Title, Items: items})
     }
 
-    // Only get the last message
-    url := fmt.Sprintf("https://slack.com/api/conversations.history?channel=%s&limit=1", n.channelID)
-    req, err := http.NewRequest("GET", url, nil)
-    if err != nil {
-        return time.Time{}, fmt.Errorf("failed to create request: %v", err)
+    for key := range state.Announced {
+        if !current[key] && !skipped[keyRelease(key)] {
+            delete(state.Announced, key)
+        }
     }
+    return fresh
+}
 
-    req.Header.Set("Authorization", "Bearer "+n.botToken)
-    
-    client := &http.Client{}
-    resp, err := client.Do(req)
-    if err != nil {
-        return time.Time{}, fmt.Errorf("failed to get channel history: %v", err)
+// SendSlackNotification sends new findings. skipped holds the namespace/name
+// of releases whose check did not complete, their findings are not forgotten.
+func (n *NotificationService) SendSlackNotification(sections []ReportSection, skipped map[string]bool) error {
+    if !n.enabled {
+        return nil // Notifications are disabled
     }
-    defer resp.Body.Close()
 
-    var history SlackHistoryResponse
-    if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
-        return time.Time{}, fmt.Errorf("failed to decode response: %v", err)
+    if n.channelID == "" || n.botToken == "" {
+        return fmt.Errorf("SLACK_CHANNEL_ID (or notifications.default_channel) and SLACK_BOT_TOKEN are required")
     }
 
-    if !history.Ok {
-        return time.Time{}, fmt.Errorf("slack API error: %s", history.Error)
+    state, err := n.store.Load()
+    if err != nil {
+        return fmt.Errorf("failed to load notification state: %v", err)
     }
 
-    if len(history.Messages) == 0 {
-        return time.Time{}, nil // No messages in channel
+    sections = n.withOwners(sections)
+    n.heldUntil = time.Time{}
+
+    if n.statusMessage {
+        routed := n.router.split(sections)
+        for _, channel := range sortedChannels(routed) {
+            if err := n.updateStatusMessage(state, channel, routed[channel]); err != nil {
+                if saveErr := n.store.Save(state); saveErr != nil {
+                    return fmt.Errorf("failed to update status message in %s: %v (%v)", channel, err, saveErr)
+                }
+                return fmt.Errorf("failed to update status message in %s: %v", channel, err)
+            }
+        }
     }
 
-    // Get the last message
-    lastMsg := history.Messages[0]
-    if strings.Contains(lastMsg.Text, "[HELM-MONITOR]") {
-        ts := strings.Split(lastMsg.Timestamp, ".")[0]
-        unix, err := strconv.ParseInt(ts, 10, 64)
-        if err != nil {
-            return time.Time{}, fmt.Errorf("failed to parse timestamp: %v", err)
+    sections = newFindings(sections, state, skipped)
+    if !hasFindings(sections) {
+        state.HeldSince = time.Time{} // held findings were resolved before delivery
+        if err := n.store.Save(state); err != nil {
+            return fmt.Errorf("failed to save notification state: %v", err)
         }
-        return time.Unix(unix, 0), nil
+        return nil // No new updates to send
     }
 
-    return time.Time{}, nil // Last message wasn't from our monitor
-}
+    // With a notification schedule, findings are collected until the first
+    // scheduled time after the oldest one was held
+    now := time.Now()
+    if n.schedule != nil {
+        since := state.HeldSince
+        if since.IsZero() {
+            since = now
+        }
+        if due := n.schedule.Next(since); now.Before(due) {
+            return n.hold(state, due, fmt.Sprintf("Next notification scheduled for UTC %s",
+                due.UTC().Format("2006-01-02 15:04:05")))
+        }
+    }
 
-func (n *NotificationService) shouldSendNotification(interval time.Duration) (bool, error) {
-    lastNotification, err := n.getLastNotificationTime()
-    if err != nil {
-        return false, fmt.Errorf("failed to get last notification time: %v", err)
+    // Findings are held during quiet hours and freezes, and sent as one
+    // digest once the window ends
+    if until, reason := n.quiet.suppressedUntil(now); !until.IsZero() {
+        return n.hold(state, until, fmt.Sprintf("Notifications held during %s until UTC %s",
+            reason, until.UTC().Format("2006-01-02 15:04:05")))
     }
 
-    if lastNotification.IsZero() {
-        return true, nil // No previous notification found, should send
+    var footer string
+    if n.schedule != nil {
+        footer = fmt.Sprintf("_Next notification will be sent after: UTC %s_",
+            n.schedule.Next(now).UTC().Format("2006-01-02 15:04:05"))
+    }
+    if !state.HeldSince.IsZero() {
+        footer = strings.TrimSpace(fmt.Sprintf("_Digest of findings held since UTC %s._ %s",
+            state.HeldSince.UTC().Format("2006-01-02 15:04:05"), footer))
     }
 
-    nextAllowedTime := lastNotification.Add(interval)
-    return time.Now().After(nextAllowedTime), nil
+    routed := n.router.split(sections)
+    var delivered []slackChunk
+    for _, channel := range sortedChannels(routed) {
+        if !hasFindings(routed[channel]) {
+            continue
+        }
+        sent, err := n.postReport(state, channel, routed[channel], footer)
+        delivered = append(delivered, sent...)
+        if err != nil {
+            if saveErr := n.markAnnounced(state, delivered); saveErr != nil {
+                return fmt.Errorf("failed to send Slack notification to %s: %v (%v)", channel, err, saveErr)
+            }
+            return fmt.Errorf("failed to send Slack notification to %s: %v", channel, err)
+        }
+    }
+
+    return n.markAnnounced(state, delivered)
 }
 
-func (n *NotificationService) SendSlackNotification(updates []string, interval time.Duration) error {
-    if !n.enabled {
-        return nil // Notifications are disabled
+// SendActions reports changes helm-monitor made, like automatic upgrades.
+// They are sent right away, outside the notification schedule, quiet hours
+// and freezes, since the cluster already changed.
+func (n *NotificationService) SendActions(section ReportSection) error {
+    if !n.enabled || len(section.Items) == 0 {
+        return nil
     }
 
     if n.channelID == "" || n.botToken == "" {
-        return fmt.Errorf("SLACK_CHANNEL_ID and SLACK_BOT_TOKEN are required")
+        return fmt.Errorf("SLACK_CHANNEL_ID (or notifications.default_channel) and SLACK_BOT_TOKEN are required")
     }
 
-    if len(updates) == 0 {
-        return nil // No updates to send
+    state, err := n.store.Load()
+    if err != nil {
+        return fmt.Errorf("failed to load notification state: %v", err)
     }
 
-    shouldSend, err := n.shouldSendNotification(interval)
-    if err != nil {
-        return fmt.Errorf("failed to check notification timing: %v", err)
+    routed := n.router.split(n.withOwners([]ReportSection{section}))
+    for _, channel := range sortedChannels(routed) {
+        if !hasFindings(routed[channel]) {
+            continue
+        }
+        if _, err := n.postReport(state, channel, routed[channel], ""); err != nil {
+            return fmt.Errorf("failed to send Slack notification to %s: %v", channel, err)
+        }
     }
+    return nil
+}
 
-    if !shouldSend {
-        return fmt.Errorf("NOTIFICATION_SKIPPED: Interval not passed yet")
+// postReport posts the report to one channel and returns the messages that
+// were delivered.
+func (n *NotificationService) postReport(state *State, channel string, sections []ReportSection, footer string) ([]slackChunk, error) {
+    chunks := renderReport(sections, footer)
+    // The fallback text shows in push notifications and keeps the identifier
+    fallback := fmt.Sprintf("[HELM-MONITOR] Helm chart report: %d new findings", countFindings(sections))
+
+    // Large reports continue as replies in the thread of the first message.
+    // With a status message, new findings are all replies in its thread.
+    var threadTS string
+    if n.statusMessage {
+        threadTS = state.StatusMessages[channel]
     }
+    for i, chunk := range chunks {
+        text := fallback
+        if i > 0 {
+            text = fmt.Sprintf("[HELM-MONITOR] Helm chart report (part %d of %d)", i+1, len(chunks))
+        }
 
-    // Create a formatted message with identifier
-    message := "[HELM-MONITOR] *Helm Chart Updates Available:*\n"
-    message += strings.Join(updates, "\n")
-    message += fmt.Sprintf("\n\n_Next notification will be sent after: UTC %s_", 
-        time.Now().Add(interval).Format("2006-01-02 15:04:05"))
+        resp, err := n.slack.call("chat.postMessage", SlackMessage{
+            Text:     text,
+            Channel:  channel,
+            Blocks:   chunk.blocks,
+            ThreadTS: threadTS,
+        })
+        if err != nil {
+            return chunks[:i], err
+        }
+        if threadTS == "" {
+            threadTS = resp.TS
+        }
+    }
+    return chunks, nil
+}
 
-    payload := SlackMessage{
-        Text:    message,
-        Channel: n.channelID,
+// hold keeps new findings for later delivery and records since when they
+// are held.
+func (n *NotificationService) hold(state *State, until time.Time, reason string) error {
+    if state.HeldSince.IsZero() {
+        state.HeldSince = time.Now()
+    }
+    n.heldUntil = until
+    if err := n.store.Save(state); err != nil {
+        return fmt.Errorf("failed to save notification state: %v", err)
     }
+    return fmt.Errorf("NOTIFICATION_SKIPPED: %s", reason)
+}
 
-    jsonPayload, err := json.Marshal(payload)
-    if err != nil {
-        return fmt.Errorf("failed to marshal JSON payload: %v", err)
+// HeldUntil returns when findings held by the last notification attempt can
+// be sent, or the zero time when nothing is held.
+func (n *NotificationService) HeldUntil() time.Time {
+    return n.heldUntil
+}
+
+// markAnnounced records the findings of delivered messages as announced.
+func (n *NotificationService) markAnnounced(state *State, chunks []slackChunk) error {
+    now := time.Now()
+    for _, chunk := range chunks {
+        for _, key := range chunk.keys {
+            state.Announced[key] = now
+        }
+    }
+    if len(chunks) > 0 {
+        state.LastNotification = now
+        state.HeldSince = time.Time{}
     }
+    if err := n.store.Save(state); err != nil {
+        return fmt.Errorf("failed to save notification state: %v", err)
+    }
+    return nil
+}
 
-    req, err := http.NewRequest("POST", "https://slack.com/api/chat.postMessage", bytes.NewBuffer(jsonPayload))
-    if err != nil {
-        return fmt.Errorf("failed to create request: %v", err)
+func formatDeprecatedChart(releaseName, namespace, chartName, installedVersion string, latest *repo.ChartVersion) string {
+    msg := fmt.Sprintf("•    *release*: %s\n      *namespace*: %s\n      *chart*: %s (installed %s, latest %s)\n",
+        releaseName, namespace, chartName, installedVersion, latest.Version)
+    if latest.Description != "" {
+        msg += fmt.Sprintf("      *description*: %s\n", latest.Description)
     }
+    return msg
+}
 
-    req.Header.Set("Content-Type", "application/json")
-    req.Header.Set("Authorization", "Bearer "+n.botToken)
+func formatVanishedVersion(releaseName, namespace, chartName, installedVersion, repoURL string) string {
+    return fmt.Sprintf("•    *release*: %s\n      *namespace*: %s\n      *chart*: %s\n      *installed*: %s (no longer published in %s)\n",
+        releaseName, namespace, chartName, installedVersion, repoURL)
+}
 
-    client := &http.Client{}
-    resp, err := client.Do(req)
-    if err != nil {
-        return fmt.Errorf("failed to send Slack notification: %v", err)
+// updateStatusMessage edits the pinned status message of a channel in place
+// with the full current report, posting and pinning a new one when there is
+// none yet.
+func (n *NotificationService) updateStatusMessage(state *State, channel string, sections []ReportSection) error {
+    blocks := renderStatus(n.clusterName, sections, time.Now())
+    text := fmt.Sprintf("[HELM-MONITOR] Helm release status: %s, %d findings", n.clusterName, countFindings(sections))
+
+    if ts := state.StatusMessages[channel]; ts != "" {
+        _, err := n.slack.call("chat.update", SlackMessage{
+            Text:      text,
+            Channel:   channel,
+            Timestamp: ts,
+            Blocks:    blocks,
+        })
+        if err == nil {
+            return nil
+        }
+        if !isSlackError(err, "message_not_found", "cant_update_message", "edit_window_closed") {
+            return err
+        }
+        // The message was deleted or can no longer be edited, start a new one
     }
-    defer resp.Body.Close()
 
-    if resp.StatusCode != http.StatusOK {
-        return fmt.Errorf("failed to send Slack notification: received status code %d", resp.StatusCode)
+    resp, err := n.slack.call("chat.postMessage", SlackMessage{
+        Text:    text,
+        Channel: channel,
+        Blocks:  blocks,
+    })
+    if err != nil {
+        return err
     }
+    state.StatusMessages[channel] = resp.TS
 
+    _, err = n.slack.call("pins.add", map[string]string{
+        "channel":   channel,
+        "timestamp": resp.TS,
+    })
+    if err != nil && !isSlackError(err, "already_pinned") {
+        return fmt.Errorf("failed to pin status message: %v", err)
+    }
     return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,103 @@
+package helm
+
+import (
+    "context"
+    "fmt"
+    "regexp"
+    "strings"
+    "helm.sh/helm/v3/pkg/release"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ownerKey is read from the Helm release labels first and from the namespace
+// annotations second. A release label is a Kubernetes label value, so it holds
+// a single Slack user group or user ID. The namespace annotation may hold a
+// comma separated list of Slack user group IDs, Slack user IDs or email
+// addresses.
+const ownerKey = "helm-monitor.io/owner"
+
+var slackIDRegex = regexp.MustCompile(`^[SUW][A-Z0-9]{8,}$`)
+
+// ownerResolver looks up release owners, caching namespace annotations for
+// the duration of one check.
+type ownerResolver struct {
+    m           *Monitor
+    annotations map[string]map[string]string
+}
+
+func (m *Monitor) newOwnerResolver() *ownerResolver {
+    return &ownerResolver{m: m, annotations: make(map[string]map[string]string)}
+}
+
+func (r *ownerResolver) owner(rel *release.Release) string {
+    if owner := strings.TrimSpace(rel.Labels[ownerKey]); owner != "" {
+        return owner
+    }
+
+    annotations, ok := r.annotations[rel.Namespace]
+    if !ok {
+        ns, err := r.m.client.CoreV1().Namespaces().Get(context.TODO(), rel.Namespace, metav1.GetOptions{})
+        if err != nil {
+            r.m.log.Debugf("Failed to get namespace %s for owner lookup: %v", rel.Namespace, err)
+        } else {
+            annotations = ns.Annotations
+        }
+        r.annotations[rel.Namespace] = annotations
+    }
+    return strings.TrimSpace(annotations[ownerKey])
+}
+
+func parseOwners(owner string) []string {
+    var owners []string
+    for _, o := range strings.Split(owner, ",") {
+        if o = strings.TrimSpace(o); o != "" {
+            owners = append(owners, o)
+        }
+    }
+    return owners
+}
+
+// mentions turns owners into Slack mentions. Email addresses are looked up
+// through users.lookupByEmail and kept as text when no user is found.
+func (n *NotificationService) mentions(owner string, cache map[string]string) string {
+    var mentions []string
+    for _, o := range parseOwners(owner) {
+        if mention, ok := cache[o]; ok {
+            mentions = append(mentions, mention)
+            continue
+        }
+
+        mention := o
+        switch {
+        case slackIDRegex.MatchString(o) && strings.HasPrefix(o, "S"):
+            mention = fmt.Sprintf("<!subteam^%s>", o)
+        case slackIDRegex.MatchString(o):
+            mention = fmt.Sprintf("<@%s>", o)
+        case strings.Contains(o, "@"):
+            if userID, err := n.slack.lookupUserByEmail(o); err == nil {
+                mention = fmt.Sprintf("<@%s>", userID)
+            }
+        }
+        cache[o] = mention
+        mentions = append(mentions, mention)
+    }
+    return strings.Join(mentions, ", ")
+}
+
+// withOwners appends the owner mentions to the text of each finding.
+func (n *NotificationService) withOwners(sections []ReportSection) []ReportSection {
+    cache := make(map[string]string)
+    var result []ReportSection
+    for _, section := range sections {
+        out := ReportSection{Title: section.Title}
+        for _, item := range section.Items {
+            if item.Owner != "" {
+                item.Text = strings.TrimRight(item.Text, "\n") +
+                    fmt.Sprintf("\n      *owner*: %s\n", n.mentions(item.Owner, cache))
+            }
+            out.Items = append(out.Items, item)
+        }
+        result = append(result, out)
+    }
+    return result
+}
@@ -0,0 +1,212 @@
+package helm
+
+import (
+    "fmt"
+    "time"
+)
+
+type QuietHoursConfig struct {
+    Timezone string   `yaml:"timezone"` // IANA time zone, defaults to UTC
+    Start    string   `yaml:"start"`    // "22:00", may wrap past midnight
+    End      string   `yaml:"end"`      // "07:00"
+    Days     []string `yaml:"days"`     // weekdays the window starts on, all days when empty
+}
+
+type FreezeConfig struct {
+    Name     string `yaml:"name"`
+    Timezone string `yaml:"timezone"`
+    Start    string `yaml:"start"` // "2025-11-27" or RFC 3339
+    End      string `yaml:"end"`   // inclusive when given as a date
+}
+
+type quietHours struct {
+    loc        *time.Location
+    start, end time.Duration // offsets from midnight
+    days       map[time.Weekday]bool
+}
+
+type freeze struct {
+    name       string
+    start, end time.Time
+}
+
+func loadLocation(name string) (*time.Location, error) {
+    if name == "" {
+        return time.UTC, nil
+    }
+    loc, err := time.LoadLocation(name)
+    if err != nil {
+        return nil, fmt.Errorf("invalid timezone %q: %v", name, err)
+    }
+    return loc, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+    t, err := time.Parse("15:04", s)
+    if err != nil {
+        return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+    }
+    return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func parseQuietHours(config QuietHoursConfig) (*quietHours, error) {
+    loc, err := loadLocation(config.Timezone)
+    if err != nil {
+        return nil, err
+    }
+
+    q := &quietHours{loc: loc, end: 24 * time.Hour}
+    if config.Start != "" || config.End != "" {
+        if q.start, err = parseClock(config.Start); err != nil {
+            return nil, err
+        }
+        if q.end, err = parseClock(config.End); err != nil {
+            return nil, err
+        }
+        if q.end <= q.start {
+            q.end += 24 * time.Hour // wraps past midnight
+        }
+    } else if len(config.Days) == 0 {
+        return nil, fmt.Errorf("quiet hours need start and end, or days")
+    }
+
+    if len(config.Days) > 0 {
+        q.days = make(map[time.Weekday]bool)
+        for _, day := range config.Days {
+            weekday, err := parseWeekday(day)
+            if err != nil {
+                return nil, err
+            }
+            q.days[weekday] = true
+        }
+    }
+    return q, nil
+}
+
+// atClock returns the wall clock time offset from midnight of day. Unlike
+// day.Add it stays correct on days a DST change makes 23 or 25 hours long.
+func atClock(day time.Time, offset time.Duration) time.Time {
+    return time.Date(day.Year(), day.Month(), day.Day(), 0, int(offset/time.Minute), 0, 0, day.Location())
+}
+
+// until returns the end of the quiet window containing t, or the zero time.
+func (q *quietHours) until(t time.Time) time.Time {
+    local := t.In(q.loc)
+    // A window wrapping past midnight may have started the day before
+    for _, offset := range []int{0, -1} {
+        day := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, q.loc)
+        if q.days != nil && !q.days[day.Weekday()] {
+            continue
+        }
+        start := atClock(day, q.start)
+        end := atClock(day, q.end)
+        if !local.Before(start) && local.Before(end) {
+            return end
+        }
+    }
+    return time.Time{}
+}
+
+func parseFreezeTime(s string, loc *time.Location, endOfDay bool) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339, s); err == nil {
+        return t, nil
+    }
+    t, err := time.ParseInLocation("2006-01-02", s, loc)
+    if err != nil {
+        return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC 3339", s)
+    }
+    if endOfDay {
+        t = t.AddDate(0, 0, 1)
+    }
+    return t, nil
+}
+
+func parseFreeze(config FreezeConfig) (*freeze, error) {
+    loc, err := loadLocation(config.Timezone)
+    if err != nil {
+        return nil, err
+    }
+    start, err := parseFreezeTime(config.Start, loc, false)
+    if err != nil {
+        return nil, err
+    }
+    end, err := parseFreezeTime(config.End, loc, true)
+    if err != nil {
+        return nil, err
+    }
+    if !end.After(start) {
+        return nil, fmt.Errorf("freeze %q ends before it starts", config.Name)
+    }
+    return &freeze{name: config.Name, start: start, end: end}, nil
+}
+
+// validateQuietConfig reports invalid quiet hours and freezes when the
+// configuration is loaded.
+func validateQuietConfig(config NotificationConfig) []string {
+    var errs []string
+    for i, qh := range config.QuietHours {
+        if _, err := parseQuietHours(qh); err != nil {
+            errs = append(errs, fmt.Sprintf("Quiet hours %d are invalid: %v", i+1, err))
+        }
+    }
+    for i, f := range config.Freezes {
+        if _, err := parseFreeze(f); err != nil {
+            errs = append(errs, fmt.Sprintf("Freeze %d (%s) is invalid: %v", i+1, f.Name, err))
+        }
+    }
+    return errs
+}
+
+type quietSchedule struct {
+    quietHours []*quietHours
+    freezes    []*freeze
+}
+
+// newQuietSchedule skips invalid entries, they are reported by loadConfig.
+func newQuietSchedule(config NotificationConfig) *quietSchedule {
+    s := &quietSchedule{}
+    for _, qh := range config.QuietHours {
+        if q, err := parseQuietHours(qh); err == nil {
+            s.quietHours = append(s.quietHours, q)
+        }
+    }
+    for _, f := range config.Freezes {
+        if fr, err := parseFreeze(f); err == nil {
+            s.freezes = append(s.freezes, fr)
+        }
+    }
+    return s
+}
+
+// suppressedUntil returns when notifications may be sent again and why they
+// are held, following windows that run into each other. It returns the zero
+// time when notifications are allowed now.
+func (s *quietSchedule) suppressedUntil(now time.Time) (time.Time, string) {
+    until := now
+    reason := ""
+    // Bounded, since adjacent windows can only chain a few times
+    for i := 0; i < 16; i++ {
+        extended := false
+        for _, f := range s.freezes {
+            if !until.Before(f.start) && until.Before(f.end) {
+                until, reason, extended = f.end, fmt.Sprintf("change freeze %s", f.name), true
+            }
+        }
+        for _, q := range s.quietHours {
+            if end := q.until(until); !end.IsZero() {
+                if reason == "" {
+                    reason = "quiet hours"
+                }
+                until, extended = end, true
+            }
+        }
+        if !extended {
+            break
+        }
+    }
+
+    if until.Equal(now) {
+        return time.Time{}, ""
+    }
+    return until, reason
+}
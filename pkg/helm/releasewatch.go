@@ -0,0 +1,126 @@
+package helm
+
+import (
+    "context"
+    "os"
+    "strings"
+    "sync"
+    "time"
+    corev1 "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/api/meta"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/client-go/informers"
+    "k8s.io/client-go/tools/cache"
+)
+
+const (
+    // Helm writes several revisions during one upgrade, checks wait until
+    // the release settles
+    releaseSettleDelay = 10 * time.Second
+    helmOwnerSelector  = "owner=helm"
+)
+
+func releaseWatchEnabled() bool {
+    switch strings.ToLower(os.Getenv("WATCH_RELEASES")) {
+    case "false", "0", "no":
+        return false
+    }
+    return true
+}
+
+// watchReleases checks a release again soon after it is installed, upgraded,
+// rolled back or uninstalled, by watching the Secrets (or ConfigMaps with
+// HELM_DRIVER=configmap) Helm stores releases in. It runs until ctx is done.
+func (m *Monitor) watchReleases(ctx context.Context) {
+    if !releaseWatchEnabled() || m.client == nil {
+        return
+    }
+
+    factory := informers.NewSharedInformerFactoryWithOptions(m.client, 0,
+        informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+            options.LabelSelector = helmOwnerSelector
+        }))
+
+    var informer cache.SharedIndexInformer
+    switch strings.ToLower(os.Getenv("HELM_DRIVER")) {
+    case "configmap", "configmaps":
+        informer = factory.Core().V1().ConfigMaps().Informer()
+    default:
+        informer = factory.Core().V1().Secrets().Informer()
+    }
+
+    // Only the labels are needed, the release payload is dropped
+    informer.SetTransform(func(obj interface{}) (interface{}, error) {
+        switch o := obj.(type) {
+        case *corev1.Secret:
+            o.Data = nil
+        case *corev1.ConfigMap:
+            o.Data = nil
+        }
+        return obj, nil
+    })
+
+    var mu sync.Mutex
+    pending := make(map[string]*time.Timer)
+    schedule := func(obj interface{}) {
+        if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+            obj = tombstone.Obj
+        }
+        accessor, err := meta.Accessor(obj)
+        if err != nil {
+            return
+        }
+        namespace, name := accessor.GetNamespace(), accessor.GetLabels()["name"]
+        if name == "" {
+            return
+        }
+
+        key := namespace + "/" + name
+        mu.Lock()
+        defer mu.Unlock()
+        if timer, ok := pending[key]; ok {
+            timer.Reset(releaseSettleDelay)
+            return
+        }
+        pending[key] = time.AfterFunc(releaseSettleDelay, func() {
+            mu.Lock()
+            delete(pending, key)
+            mu.Unlock()
+            if ctx.Err() != nil || !m.leader.Load() {
+                return
+            }
+            m.log.Infof("Helm release %s in namespace: %s changed, checking it", name, namespace)
+            m.CheckRelease(namespace, name)
+        })
+    }
+
+    informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+        AddFunc: func(obj interface{}, isInInitialList bool) {
+            // The scheduled check covers releases that existed at start
+            if !isInInitialList {
+                schedule(obj)
+            }
+        },
+        UpdateFunc: func(oldObj, newObj interface{}) {
+            oldAccessor, err1 := meta.Accessor(oldObj)
+            newAccessor, err2 := meta.Accessor(newObj)
+            // Resyncs and unrelated changes keep the status label
+            if err1 == nil && err2 == nil && oldAccessor.GetLabels()["status"] == newAccessor.GetLabels()["status"] {
+                return
+            }
+            schedule(newObj)
+        },
+        DeleteFunc: schedule,
+    })
+
+    m.log.Info("Watching Helm release storage for changes")
+    factory.Start(ctx.Done())
+    <-ctx.Done()
+
+    mu.Lock()
+    for _, timer := range pending {
+        timer.Stop()
+    }
+    mu.Unlock()
+    factory.Shutdown()
+}
@@ -0,0 +1,217 @@
+package helm
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "time"
+    "github.com/Masterminds/semver/v3"
+    "helm.sh/helm/v3/pkg/release"
+    apierrors "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+    "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+    reportAPIVersion = "helm-monitor.io/v1alpha1"
+    reportKind       = "HelmReleaseReport"
+    managedByLabel   = "app.kubernetes.io/managed-by"
+)
+
+var reportResource = schema.GroupVersionResource{
+    Group:    "helm-monitor.io",
+    Version:  "v1alpha1",
+    Resource: "helmreleasereports",
+}
+
+type ReleaseReportSpec struct {
+    Release    string `json:"release"`
+    Chart      string `json:"chart"`
+    Repository string `json:"repository"`
+}
+
+type ReleaseFinding struct {
+    Type    string `json:"type"`
+    Section string `json:"section"`
+    Message string `json:"message"`
+}
+
+type ReleaseReportStatus struct {
+    ReleaseStatus       string           `json:"releaseStatus"`
+    Revision            int              `json:"revision"`
+    InstalledVersion    string           `json:"installedVersion"`
+    InstalledAppVersion string           `json:"installedAppVersion,omitempty"`
+    LatestVersion       string           `json:"latestVersion,omitempty"`
+    LatestAppVersion    string           `json:"latestAppVersion,omitempty"`
+    Bump                string           `json:"bump,omitempty"`          // major, minor, patch or none
+    UpgradeDryRun       string           `json:"upgradeDryRun,omitempty"` // passed, failed or not-validated
+    FindingCount        int              `json:"findingCount"`
+    Findings            []ReleaseFinding `json:"findings,omitempty"`
+    LastChecked         string           `json:"lastChecked"`
+}
+
+// releaseReport is the HelmReleaseReport of one tracked release.
+type releaseReport struct {
+    namespace string
+    spec      ReleaseReportSpec
+    status    ReleaseReportStatus
+}
+
+func newReleaseReport(rel *release.Release, repository, chartName string) *releaseReport {
+    r := &releaseReport{
+        namespace: rel.Namespace,
+        spec:      ReleaseReportSpec{Release: rel.Name, Chart: chartName, Repository: repository},
+        status: ReleaseReportStatus{
+            Revision:            rel.Version,
+            InstalledVersion:    rel.Chart.Metadata.Version,
+            InstalledAppVersion: rel.Chart.Metadata.AppVersion,
+        },
+    }
+    if rel.Info != nil {
+        r.status.ReleaseStatus = rel.Info.Status.String()
+    }
+    return r
+}
+
+// bumpLevel names the largest semver part that changes between versions.
+func bumpLevel(current, latest *semver.Version) string {
+    switch {
+    case !latest.GreaterThan(current):
+        return "none"
+    case latest.Major() != current.Major():
+        return "major"
+    case latest.Minor() != current.Minor():
+        return "minor"
+    default:
+        return "patch"
+    }
+}
+
+// plainText drops the Slack formatting of a finding.
+func plainText(text string) string {
+    var lines []string
+    for _, line := range strings.Split(text, "\n") {
+        line = strings.TrimSpace(strings.NewReplacer("*", "", "•", "", "`", "").Replace(line))
+        if line != "" {
+            lines = append(lines, line)
+        }
+    }
+    return strings.Join(lines, "; ")
+}
+
+// addFindings attaches the findings of the report sections to the release
+// reports they belong to.
+func addFindings(reports map[string]*releaseReport, sections []ReportSection) {
+    for _, section := range sections {
+        for _, item := range section.Items {
+            r, ok := reports[item.Namespace+"/"+item.Release]
+            if !ok {
+                continue
+            }
+            r.status.Findings = append(r.status.Findings, ReleaseFinding{
+                Type:    strings.SplitN(item.Key, "/", 2)[0],
+                Section: section.Title,
+                Message: plainText(item.Text),
+            })
+        }
+    }
+    for _, r := range reports {
+        r.status.FindingCount = len(r.status.Findings)
+    }
+}
+
+func (r *releaseReport) object() (*unstructured.Unstructured, error) {
+    spec, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&r.spec)
+    if err != nil {
+        return nil, err
+    }
+    obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+    obj.SetAPIVersion(reportAPIVersion)
+    obj.SetKind(reportKind)
+    obj.SetName(r.spec.Release)
+    obj.SetNamespace(r.namespace)
+    obj.SetLabels(map[string]string{managedByLabel: "helm-monitor"})
+    return obj, nil
+}
+
+// publishReports creates or updates a HelmReleaseReport for each tracked
+// release. With prune, after a check of all releases, the reports of releases
+// that are no longer tracked are deleted. Nothing is published when the CRD
+// is not installed.
+func (m *Monitor) publishReports(reports map[string]*releaseReport, prune bool) {
+    if m.dynamic == nil {
+        return
+    }
+    client := m.dynamic.Resource(reportResource)
+    selector := managedByLabel + "=helm-monitor"
+
+    existing, err := client.Namespace(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+    if apierrors.IsNotFound(err) {
+        m.log.Debug("HelmReleaseReport CRD is not installed, skipping reports")
+        return
+    }
+    if err != nil {
+        m.log.Errorf("Failed to list HelmReleaseReports: %v", err)
+        return
+    }
+
+    current := make(map[string]*unstructured.Unstructured)
+    for i := range existing.Items {
+        obj := &existing.Items[i]
+        current[obj.GetNamespace()+"/"+obj.GetName()] = obj
+    }
+
+    checkedAt := time.Now().UTC().Format(time.RFC3339)
+    for key, r := range reports {
+        r.status.LastChecked = checkedAt
+        if err := m.publishReport(r, current[key]); err != nil {
+            m.log.Errorf("Failed to publish HelmReleaseReport for helm release %s in namespace: %s: %v",
+                r.spec.Release, r.namespace, err)
+        }
+    }
+
+    if !prune {
+        return
+    }
+    for key, obj := range current {
+        if _, tracked := reports[key]; tracked {
+            continue
+        }
+        err := client.Namespace(obj.GetNamespace()).Delete(context.TODO(), obj.GetName(), metav1.DeleteOptions{})
+        if err != nil && !apierrors.IsNotFound(err) {
+            m.log.Errorf("Failed to delete HelmReleaseReport %s: %v", key, err)
+        }
+    }
+}
+
+func (m *Monitor) publishReport(r *releaseReport, obj *unstructured.Unstructured) error {
+    client := m.dynamic.Resource(reportResource).Namespace(r.namespace)
+    desired, err := r.object()
+    if err != nil {
+        return fmt.Errorf("failed to build report: %v", err)
+    }
+
+    if obj == nil {
+        if obj, err = client.Create(context.TODO(), desired, metav1.CreateOptions{}); err != nil {
+            return fmt.Errorf("failed to create report: %v", err)
+        }
+    } else {
+        obj.Object["spec"] = desired.Object["spec"]
+        if obj, err = client.Update(context.TODO(), obj, metav1.UpdateOptions{}); err != nil {
+            return fmt.Errorf("failed to update report: %v", err)
+        }
+    }
+
+    // The status subresource ignores status in create and update
+    status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&r.status)
+    if err != nil {
+        return fmt.Errorf("failed to build report status: %v", err)
+    }
+    obj.Object["status"] = status
+    if _, err := client.UpdateStatus(context.TODO(), obj, metav1.UpdateOptions{}); err != nil {
+        return fmt.Errorf("failed to update report status: %v", err)
+    }
+    return nil
+}
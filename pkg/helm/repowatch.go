@@ -0,0 +1,215 @@
+package helm
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "sort"
+    "strings"
+    "time"
+    "helm.sh/helm/v3/pkg/repo"
+)
+
+const defaultRepoPollInterval = "5m"
+
+// trackedChart is the repository and chart a release was checked against.
+type trackedChart struct {
+    repository string
+    chart      string
+}
+
+// indexState is what the last poll of a repository index returned.
+type indexState struct {
+    etag         string
+    lastModified string
+    latest       map[string]string // newest version per tracked chart
+}
+
+func repoPollInterval() (time.Duration, error) {
+    value := os.Getenv("REPO_POLL_INTERVAL")
+    if value == "" {
+        value = defaultRepoPollInterval
+    }
+    if value == "0" || value == "off" {
+        return 0, nil
+    }
+    return parseRegularInterval(value)
+}
+
+// releasesUsing returns the releases last checked against a chart of a
+// repository, or against any chart of it when chartName is empty.
+func (m *Monitor) releasesUsing(repoURL, chartName string) map[string]bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    releases := make(map[string]bool)
+    for key, tracked := range m.tracked {
+        if sameRepository(tracked.repository, repoURL) && (chartName == "" || tracked.chart == chartName) {
+            releases[key] = true
+        }
+    }
+    return releases
+}
+
+func sameRepository(a, b string) bool {
+    return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+// checkReleaseSet checks the given releases, keyed by namespace/name.
+func (m *Monitor) checkReleaseSet(releases map[string]bool) {
+    if len(releases) == 0 {
+        return
+    }
+    m.checkReleases(func(namespace, name string) bool {
+        return releases[namespace+"/"+name]
+    })
+}
+
+// trackedCharts returns the charts to watch per repository URL.
+func (m *Monitor) trackedCharts() map[string]map[string]bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    charts := make(map[string]map[string]bool)
+    if m.config == nil {
+        return charts
+    }
+    for _, repo := range m.config.Repositories {
+        // Only HTTP repositories serve an index
+        if !strings.HasPrefix(repo.URL, "http://") && !strings.HasPrefix(repo.URL, "https://") {
+            continue
+        }
+        if charts[repo.URL] == nil {
+            charts[repo.URL] = make(map[string]bool)
+        }
+        for _, chartMapping := range repo.Charts {
+            charts[repo.URL][chartMapping.RemoteName] = true
+        }
+    }
+    return charts
+}
+
+// watchRepositories polls the repository indexes every REPO_POLL_INTERVAL
+// and checks the releases of a chart as soon as it publishes a new version.
+// It runs until ctx is done.
+func (m *Monitor) watchRepositories(ctx context.Context) {
+    interval, err := repoPollInterval()
+    if err != nil {
+        m.log.Errorf("Invalid REPO_POLL_INTERVAL, not watching repositories: %v", err)
+        return
+    }
+    if interval <= 0 {
+        return
+    }
+
+    m.log.Infof("Watching repository indexes every %s", interval)
+    client := &http.Client{Timeout: 2 * time.Minute}
+    states := make(map[string]*indexState)
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        for repoURL, charts := range m.trackedCharts() {
+            state, ok := states[repoURL]
+            if !ok {
+                state = &indexState{latest: make(map[string]string)}
+                states[repoURL] = state
+            }
+
+            published, err := m.pollRepository(ctx, client, repoURL, charts, state)
+            if err != nil {
+                m.log.Warnf("Failed to poll repository %s: %v", repoURL, err)
+                continue
+            }
+            for _, chartName := range published {
+                m.log.Infof("Chart %s published version %s in %s, checking its releases",
+                    chartName, state.latest[chartName], repoURL)
+                m.checkReleaseSet(m.releasesUsing(repoURL, chartName))
+            }
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// pollRepository fetches the index with a conditional request and returns
+// the charts whose newest version changed since the last poll. The first
+// poll of a repository only records the versions.
+func (m *Monitor) pollRepository(ctx context.Context, client *http.Client, repoURL string,
+    charts map[string]bool, state *indexState) ([]string, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(repoURL, "/")+"/index.yaml", nil)
+    if err != nil {
+        return nil, err
+    }
+    if state.etag != "" {
+        req.Header.Set("If-None-Match", state.etag)
+    }
+    if state.lastModified != "" {
+        req.Header.Set("If-Modified-Since", state.lastModified)
+    }
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusNotModified {
+        m.log.Debugf("Repository index %s not modified", repoURL)
+        return nil, nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("unexpected status %s", resp.Status)
+    }
+
+    index, err := loadIndex(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    state.etag = resp.Header.Get("ETag")
+    state.lastModified = resp.Header.Get("Last-Modified")
+
+    var published []string
+    for chartName := range charts {
+        versions := index.Entries[chartName]
+        if len(versions) == 0 {
+            continue
+        }
+        newest := versions[0].Version
+        if previous, ok := state.latest[chartName]; ok && previous != newest {
+            published = append(published, chartName)
+        }
+        state.latest[chartName] = newest
+    }
+    sort.Strings(published)
+    return published, nil
+}
+
+// loadIndex parses an index through a temporary file, the same way
+// getChartVersions loads downloaded indexes.
+func loadIndex(r io.Reader) (*repo.IndexFile, error) {
+    f, err := os.CreateTemp("", "helm-index-*.yaml")
+    if err != nil {
+        return nil, fmt.Errorf("failed to create temp file: %v", err)
+    }
+    defer os.Remove(f.Name())
+
+    if _, err := io.Copy(f, r); err != nil {
+        f.Close()
+        return nil, fmt.Errorf("failed to read index: %v", err)
+    }
+    if err := f.Close(); err != nil {
+        return nil, fmt.Errorf("failed to write index: %v", err)
+    }
+
+    index, err := repo.LoadIndexFile(f.Name())
+    if err != nil {
+        return nil, fmt.Errorf("failed to load index file: %v", err)
+    }
+    return index, nil
+}
@@ -0,0 +1,148 @@
+package helm
+
+import (
+    "context"
+    "regexp"
+    "sort"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/client-go/kubernetes"
+)
+
+type route struct {
+    channel         string
+    namespaces      map[string]bool
+    namespaceLabels map[string]string
+    releasePattern  *regexp.Regexp
+    charts          map[string]bool
+}
+
+// router picks the Slack channel for each finding from the notification
+// routes, falling back to the default channel.
+type router struct {
+    routes         []route
+    defaultChannel string
+    client         kubernetes.Interface
+}
+
+func newRouter(config NotificationConfig, defaultChannel string, client kubernetes.Interface) *router {
+    r := &router{defaultChannel: defaultChannel, client: client}
+    for _, rc := range config.Routes {
+        r.routes = append(r.routes, newRoute(rc))
+    }
+    return r
+}
+
+func newRoute(rc RouteConfig) route {
+    rt := route{
+        channel:         rc.Channel,
+        namespaceLabels: rc.NamespaceLabels,
+    }
+    if len(rc.Namespaces) > 0 {
+        rt.namespaces = make(map[string]bool)
+        for _, ns := range rc.Namespaces {
+            rt.namespaces[ns] = true
+        }
+    }
+    if len(rc.Charts) > 0 {
+        rt.charts = make(map[string]bool)
+        for _, c := range rc.Charts {
+            rt.charts[c] = true
+        }
+    }
+    if rc.ReleasePattern != "" {
+        // Patterns are validated when the configuration is loaded
+        rt.releasePattern = regexp.MustCompile(rc.ReleasePattern)
+    }
+    return rt
+}
+
+// channels returns every destination, so each one gets a status message
+// even when none of its releases have findings.
+func (r *router) channels() []string {
+    seen := map[string]bool{r.defaultChannel: true}
+    channels := []string{r.defaultChannel}
+    for _, rt := range r.routes {
+        if !seen[rt.channel] {
+            seen[rt.channel] = true
+            channels = append(channels, rt.channel)
+        }
+    }
+    return channels
+}
+
+// split groups the report sections by destination channel.
+func (r *router) split(sections []ReportSection) map[string][]ReportSection {
+    labels := make(map[string]map[string]string)
+    namespaceLabels := func(namespace string) map[string]string {
+        if l, ok := labels[namespace]; ok {
+            return l
+        }
+        var l map[string]string
+        if r.client != nil {
+            if ns, err := r.client.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{}); err == nil {
+                l = ns.Labels
+            }
+        }
+        labels[namespace] = l
+        return l
+    }
+
+    routed := make(map[string][]ReportSection)
+    for _, channel := range r.channels() {
+        for _, section := range sections {
+            routed[channel] = append(routed[channel], ReportSection{Title: section.Title})
+        }
+    }
+
+    for i, section := range sections {
+        for _, item := range section.Items {
+            channel := r.channelFor(item, namespaceLabels)
+            routed[channel][i].Items = append(routed[channel][i].Items, item)
+        }
+    }
+    return routed
+}
+
+func (r *router) channelFor(item ReportItem, namespaceLabels func(string) map[string]string) string {
+    for _, rt := range r.routes {
+        if rt.matches(item, namespaceLabels) {
+            return rt.channel
+        }
+    }
+    return r.defaultChannel
+}
+
+// matches reports whether the release of a finding is selected by the route.
+func (rt *route) matches(item ReportItem, namespaceLabels func(string) map[string]string) bool {
+    if rt.namespaces != nil && !rt.namespaces[item.Namespace] {
+        return false
+    }
+    if rt.charts != nil && !rt.charts[item.Chart] {
+        return false
+    }
+    if rt.releasePattern != nil && !rt.releasePattern.MatchString(item.Release) {
+        return false
+    }
+    if len(rt.namespaceLabels) > 0 && !labelsMatch(namespaceLabels(item.Namespace), rt.namespaceLabels) {
+        return false
+    }
+    return true
+}
+
+func labelsMatch(labels, selector map[string]string) bool {
+    for key, value := range selector {
+        if labels[key] != value {
+            return false
+        }
+    }
+    return true
+}
+
+func sortedChannels(routed map[string][]ReportSection) []string {
+    var channels []string
+    for channel := range routed {
+        channels = append(channels, channel)
+    }
+    sort.Strings(channels)
+    return channels
+}
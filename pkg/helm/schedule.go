@@ -0,0 +1,406 @@
+package helm
+
+import (
+    "fmt"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    defaultCheckInterval = "6h"
+    notifyImmediate      = "immediate"
+)
+
+// Schedule decides when the next check runs.
+type Schedule interface {
+    Next(after time.Time) time.Time
+    String() string
+}
+
+type intervalSchedule struct {
+    interval time.Duration
+}
+
+func (s *intervalSchedule) Next(after time.Time) time.Time {
+    return after.Add(s.interval)
+}
+
+func (s *intervalSchedule) String() string {
+    return "every " + s.interval.String()
+}
+
+// cronSchedule is a standard five field cron expression evaluated in a fixed
+// time zone. Each field is a bit set of the allowed values.
+type cronSchedule struct {
+    expr                          string
+    loc                           *time.Location
+    minute, hour, dom, month, dow uint64
+    domRestricted, dowRestricted  bool
+}
+
+type multiSchedule []Schedule
+
+// Next returns the earliest next run of all schedules.
+func (s multiSchedule) Next(after time.Time) time.Time {
+    var next time.Time
+    for _, schedule := range s {
+        if t := schedule.Next(after); next.IsZero() || t.Before(next) {
+            next = t
+        }
+    }
+    return next
+}
+
+func (s multiSchedule) String() string {
+    var parts []string
+    for _, schedule := range s {
+        parts = append(parts, schedule.String())
+    }
+    return strings.Join(parts, "; ")
+}
+
+var cronDescriptors = map[string]string{
+    "@yearly":   "0 0 1 1 *",
+    "@annually": "0 0 1 1 *",
+    "@monthly":  "0 0 1 * *",
+    "@weekly":   "0 0 * * 0",
+    "@daily":    "0 0 * * *",
+    "@midnight": "0 0 * * *",
+    "@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{
+    "jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+    "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+    "sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// parseSchedules parses one or more schedules separated by ";". Each one is a
+// cron expression, optionally prefixed with CRON_TZ=<zone>, or one of the
+// interval formats "1m", "1h", "1d", "1w" and "1w/monday".
+func parseSchedules(spec string, loc *time.Location) (Schedule, error) {
+    var schedules multiSchedule
+    for _, part := range strings.Split(spec, ";") {
+        part = strings.TrimSpace(part)
+        if part == "" {
+            continue
+        }
+        schedule, err := parseSchedule(part, loc)
+        if err != nil {
+            return nil, err
+        }
+        schedules = append(schedules, schedule)
+    }
+
+    switch len(schedules) {
+    case 0:
+        return nil, fmt.Errorf("empty schedule")
+    case 1:
+        return schedules[0], nil
+    default:
+        return schedules, nil
+    }
+}
+
+func parseSchedule(spec string, loc *time.Location) (Schedule, error) {
+    // Weekly intervals run at midnight on the given day, Monday by default
+    weeklyRegex := regexp.MustCompile(`^(\d+)w(?:/(\w+))?$`)
+    if matches := weeklyRegex.FindStringSubmatch(spec); matches != nil {
+        weekday := time.Monday
+        if matches[2] != "" {
+            var err error
+            weekday, err = parseWeekday(matches[2])
+            if err != nil {
+                return nil, fmt.Errorf("invalid weekday: %v", err)
+            }
+        }
+        return parseCron(fmt.Sprintf("0 0 * * %d", weekday), loc)
+    }
+
+    if strings.HasPrefix(spec, "@") || strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") ||
+        len(strings.Fields(spec)) == 5 {
+        return parseCron(spec, loc)
+    }
+
+    // Handle regular intervals (minutes, hours, days)
+    value, err := parseRegularInterval(spec)
+    if err != nil || value <= 0 {
+        return nil, fmt.Errorf("invalid schedule %q. Valid formats: cron expressions like '0 9 * * MON-FRI', '1m', '1h', '1d', '1w', or '1w/monday' for weekly schedule", spec)
+    }
+    return &intervalSchedule{interval: value}, nil
+}
+
+func parseWeekday(day string) (time.Weekday, error) {
+    days := map[string]time.Weekday{
+        "sunday":    time.Sunday,
+        "monday":    time.Monday,
+        "tuesday":   time.Tuesday,
+        "wednesday": time.Wednesday,
+        "thursday":  time.Thursday,
+        "friday":    time.Friday,
+        "saturday":  time.Saturday,
+    }
+
+    if weekday, ok := days[strings.ToLower(day)]; ok {
+        return weekday, nil
+    }
+    return 0, fmt.Errorf("invalid weekday: %s", day)
+}
+
+func parseRegularInterval(s string) (time.Duration, error) {
+    if strings.HasSuffix(s, "d") {
+        days, err := strconv.Atoi(s[:len(s)-1])
+        if err != nil {
+            return 0, fmt.Errorf("invalid day value: %v", err)
+        }
+        return time.Hour * 24 * time.Duration(days), nil
+    }
+
+    // Handle minutes and hours directly with time.ParseDuration
+    duration, err := time.ParseDuration(s)
+    if err != nil {
+        return 0, fmt.Errorf("invalid duration: %v", err)
+    }
+
+    return duration, nil
+}
+
+func parseCron(spec string, loc *time.Location) (*cronSchedule, error) {
+    expr := spec
+    for _, prefix := range []string{"CRON_TZ=", "TZ="} {
+        if strings.HasPrefix(spec, prefix) {
+            fields := strings.SplitN(strings.TrimPrefix(spec, prefix), " ", 2)
+            if len(fields) != 2 {
+                return nil, fmt.Errorf("invalid cron expression %q", spec)
+            }
+            var err error
+            if loc, err = loadLocation(fields[0]); err != nil {
+                return nil, err
+            }
+            spec = strings.TrimSpace(fields[1])
+        }
+    }
+    if descriptor, ok := cronDescriptors[spec]; ok {
+        spec = descriptor
+    }
+
+    fields := strings.Fields(spec)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields", expr)
+    }
+
+    s := &cronSchedule{expr: expr, loc: loc}
+    var err error
+    if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+        return nil, fmt.Errorf("invalid minute in %q: %v", expr, err)
+    }
+    if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+        return nil, fmt.Errorf("invalid hour in %q: %v", expr, err)
+    }
+    if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+        return nil, fmt.Errorf("invalid day of month in %q: %v", expr, err)
+    }
+    if s.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+        return nil, fmt.Errorf("invalid month in %q: %v", expr, err)
+    }
+    // Day of week allows 7 for Sunday
+    if s.dow, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+        return nil, fmt.Errorf("invalid day of week in %q: %v", expr, err)
+    }
+    if s.dow&(1<<7) != 0 {
+        s.dow |= 1
+    }
+    s.domRestricted = fields[2] != "*" && fields[2] != "?"
+    s.dowRestricted = fields[4] != "*" && fields[4] != "?"
+    return s, nil
+}
+
+func parseCronValue(s string, names map[string]int) (int, error) {
+    if v, ok := names[strings.ToLower(s)]; ok {
+        return v, nil
+    }
+    return strconv.Atoi(s)
+}
+
+// parseCronField parses lists of values, ranges and steps, e.g. "1-5",
+// "*/15", "MON,WED,FRI" or "0-30/10".
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(field, ",") {
+        step := 1
+        if i := strings.Index(part, "/"); i >= 0 {
+            var err error
+            if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+                return 0, fmt.Errorf("invalid step %q", part[i+1:])
+            }
+            part = part[:i]
+        }
+
+        lo, hi := min, max
+        switch {
+        case part == "*" || part == "?":
+        case strings.Contains(part, "-"):
+            bounds := strings.SplitN(part, "-", 2)
+            var err error
+            if lo, err = parseCronValue(bounds[0], names); err != nil {
+                return 0, fmt.Errorf("invalid value %q", bounds[0])
+            }
+            if hi, err = parseCronValue(bounds[1], names); err != nil {
+                return 0, fmt.Errorf("invalid value %q", bounds[1])
+            }
+        default:
+            v, err := parseCronValue(part, names)
+            if err != nil {
+                return 0, fmt.Errorf("invalid value %q", part)
+            }
+            lo, hi = v, v
+            if step > 1 {
+                hi = max
+            }
+        }
+
+        if lo < min || hi > max || lo > hi {
+            return 0, fmt.Errorf("value out of range %d-%d", min, max)
+        }
+        for v := lo; v <= hi; v += step {
+            bits |= 1 << uint(v)
+        }
+    }
+    return bits, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+    domMatch := s.dom&(1<<uint(t.Day())) != 0
+    dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+    // Like cron, a day matches either field when both are restricted
+    if s.domRestricted && s.dowRestricted {
+        return domMatch || dowMatch
+    }
+    return domMatch && dowMatch
+}
+
+// Next returns the next run after the given time. Like cron, a schedule with
+// fixed hours runs once when the clocks go back, and runs right after the
+// change when the clocks go forward over one of its times. Schedules running
+// every hour follow the clock as it is.
+func (s *cronSchedule) Next(after time.Time) time.Time {
+    t := after.In(s.loc).Truncate(time.Minute).Add(time.Minute)
+    // Give up after five years, which only happens for dates like 31 February
+    limit := t.AddDate(5, 0, 0)
+    for t.Before(limit) {
+        var next time.Time
+        switch {
+        case s.month&(1<<uint(t.Month())) == 0:
+            next = s.date(t.Year(), t.Month()+1, 1, 0)
+        case !s.dayMatches(t):
+            next = s.date(t.Year(), t.Month(), t.Day()+1, 0)
+        case s.hour&(1<<uint(t.Hour())) == 0:
+            next = s.date(t.Year(), t.Month(), t.Day(), t.Hour()+1)
+        case s.minute&(1<<uint(t.Minute())) == 0 || (s.fixedHours() && repeatedWallClock(t)):
+            next = t.Add(time.Minute)
+        default:
+            return t
+        }
+        if s.fixedHours() && s.skipped(t, next) {
+            return next
+        }
+        t = next
+    }
+    return time.Time{}
+}
+
+// date is the start of the hour in the time zone of the schedule. Of the
+// wall clock times repeated when the clocks go back it takes the first.
+func (s *cronSchedule) date(year int, month time.Month, day, hour int) time.Time {
+    t := time.Date(year, month, day, hour, 0, 0, 0, s.loc)
+    if repeatedWallClock(t) {
+        _, offset := t.Zone()
+        _, before := t.Add(-time.Hour).Zone()
+        t = t.Add(-time.Duration(before-offset) * time.Second)
+    }
+    return t
+}
+
+func (s *cronSchedule) fixedHours() bool {
+    return s.hour != 1<<24-1
+}
+
+// skipped reports whether the clocks went forward between from and to over
+// a time the schedule runs at.
+func (s *cronSchedule) skipped(from, to time.Time) bool {
+    _, fromOffset := from.Zone()
+    _, toOffset := to.Zone()
+    if toOffset <= fromOffset {
+        return false
+    }
+    // The wall clock times of the gap, kept in UTC so they exist
+    end := time.Date(to.Year(), to.Month(), to.Day(), to.Hour(), to.Minute(), 0, 0, time.UTC)
+    for wall := end.Add(-time.Duration(toOffset-fromOffset) * time.Second); wall.Before(end); wall = wall.Add(time.Minute) {
+        if s.month&(1<<uint(wall.Month())) != 0 && s.dayMatches(wall) &&
+            s.hour&(1<<uint(wall.Hour())) != 0 && s.minute&(1<<uint(wall.Minute())) != 0 {
+            return true
+        }
+    }
+    return false
+}
+
+// repeatedWallClock reports whether the wall clock time of t already passed
+// before the clocks went back.
+func repeatedWallClock(t time.Time) bool {
+    _, offset := t.Zone()
+    _, before := t.Add(-time.Hour).Zone()
+    if before <= offset {
+        return false
+    }
+    _, earlier := t.Add(-time.Duration(before-offset) * time.Second).Zone()
+    return earlier > offset
+}
+
+func (s *cronSchedule) String() string {
+    return fmt.Sprintf("%s (%s)", s.expr, s.loc)
+}
+
+// loadSchedule reads CHECK_SCHEDULE, falling back to CHECK_INTERVAL, and
+// evaluates cron expressions in CHECK_TIMEZONE, the local time zone by default.
+func loadSchedule() (Schedule, string, error) {
+    loc := time.Local
+    if tz := os.Getenv("CHECK_TIMEZONE"); tz != "" {
+        var err error
+        if loc, err = loadLocation(tz); err != nil {
+            return nil, "", fmt.Errorf("invalid CHECK_TIMEZONE: %v", err)
+        }
+    }
+
+    spec := os.Getenv("CHECK_SCHEDULE")
+    if spec == "" {
+        spec = os.Getenv("CHECK_INTERVAL")
+    }
+    if spec == "" {
+        spec = defaultCheckInterval
+    }
+
+    schedule, err := parseSchedules(spec, loc)
+    if err != nil {
+        return nil, spec, err
+    }
+    return schedule, spec, nil
+}
+
+// parseNotificationSchedule returns the schedule for notifications, or nil
+// when new findings are sent right after each check.
+func parseNotificationSchedule(config NotificationConfig) (Schedule, error) {
+    if config.Schedule == "" || config.Schedule == notifyImmediate {
+        return nil, nil
+    }
+    loc, err := loadLocation(config.Timezone)
+    if err != nil {
+        return nil, err
+    }
+    return parseSchedules(config.Schedule, loc)
+}
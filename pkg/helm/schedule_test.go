@@ -0,0 +1,104 @@
+package helm
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+    tests := []string{
+        "",
+        "* * * *",
+        "* * * * * *",
+        "60 * * * *",
+        "* 24 * * *",
+        "* * 0 * *",
+        "* * 32 * *",
+        "* * * 13 *",
+        "* * * * 8",
+        "*/0 * * * *",
+        "*/x * * * *",
+        "5-1 * * * *",
+        "1-x * * * *",
+        "* * * FOO *",
+        "* * * * MON-FOO",
+        "CRON_TZ=UTC",
+        "CRON_TZ=Mars/Olympus 0 0 * * *",
+    }
+    for _, spec := range tests {
+        if _, err := parseCron(spec, time.UTC); err == nil {
+            t.Errorf("parseCron(%q) succeeded, want an error", spec)
+        }
+    }
+}
+
+func TestCronScheduleNext(t *testing.T) {
+    // Berlin switches to summer time on 31 March 2024 at 02:00, and back on
+    // 27 October 2024 at 03:00
+    t.Setenv("CHECK_TIMEZONE", "Europe/Berlin")
+
+    tests := []struct {
+        spec  string
+        after string
+        want  string // empty when the schedule never runs
+    }{
+        {"0 9 * * MON-FRI", "2024-03-29T10:00:00+01:00", "2024-04-01T09:00:00+02:00"},
+        {"0 9 * * mon,wed,fri", "2024-04-01T09:00:00+02:00", "2024-04-03T09:00:00+02:00"},
+        {"0-30/15 8 * * *", "2024-05-01T08:16:00+02:00", "2024-05-01T08:30:00+02:00"},
+        {"5/20 * * * *", "2024-05-01T10:06:00+02:00", "2024-05-01T10:25:00+02:00"},
+        {"0 12 * JAN,JUL SUN", "2024-06-01T00:00:00+02:00", "2024-07-07T12:00:00+02:00"},
+        {"0 0 * * 7", "2024-06-01T00:00:00+02:00", "2024-06-02T00:00:00+02:00"},
+        {"@daily", "2024-03-30T12:00:00+01:00", "2024-03-31T00:00:00+01:00"},
+        {"CRON_TZ=UTC 0 6 * * *", "2024-03-31T00:00:00+01:00", "2024-03-31T06:00:00Z"},
+        {"0 0 31 2 *", "2024-01-01T00:00:00+01:00", ""},
+
+        // Day of month or day of week when both are restricted
+        {"0 0 1,15 * MON", "2024-06-01T00:00:00+02:00", "2024-06-03T00:00:00+02:00"},
+        {"0 0 13 * FRI", "2024-09-01T00:00:00+02:00", "2024-09-06T00:00:00+02:00"},
+        {"0 0 13 * *", "2024-09-01T00:00:00+02:00", "2024-09-13T00:00:00+02:00"},
+
+        // Spring forward, 02:00 to 02:59 do not exist
+        {"30 2 * * *", "2024-03-30T03:00:00+01:00", "2024-03-31T03:00:00+02:00"},
+        {"30 2 * * *", "2024-03-31T03:00:00+02:00", "2024-04-01T02:30:00+02:00"},
+        {"30 1-3 * * *", "2024-03-31T01:30:00+01:00", "2024-03-31T03:00:00+02:00"},
+        {"30 1-3 * * *", "2024-03-31T03:00:00+02:00", "2024-03-31T03:30:00+02:00"},
+        {"*/30 * * * *", "2024-03-31T01:30:00+01:00", "2024-03-31T03:00:00+02:00"},
+        {"0 4 * * *", "2024-03-30T05:00:00+01:00", "2024-03-31T04:00:00+02:00"},
+
+        // Fall back, 02:00 to 02:59 happen twice
+        {"30 2 * * *", "2024-10-26T03:00:00+02:00", "2024-10-27T02:30:00+02:00"},
+        {"30 2 * * *", "2024-10-27T02:30:00+02:00", "2024-10-28T02:30:00+01:00"},
+        {"0 2,3 * * *", "2024-10-27T02:00:00+02:00", "2024-10-27T03:00:00+01:00"},
+        {"0 * * * *", "2024-10-27T02:00:00+02:00", "2024-10-27T02:00:00+01:00"},
+        {"0 * * * *", "2024-10-27T02:00:00+01:00", "2024-10-27T03:00:00+01:00"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.spec+" after "+tt.after, func(t *testing.T) {
+            t.Setenv("CHECK_SCHEDULE", tt.spec)
+            schedule, _, err := loadSchedule()
+            if err != nil {
+                t.Fatalf("loadSchedule failed: %v", err)
+            }
+            after, err := time.Parse(time.RFC3339, tt.after)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            next := schedule.Next(after)
+            if tt.want == "" {
+                if !next.IsZero() {
+                    t.Errorf("Next(%s) = %s, want never", tt.after, next.Format(time.RFC3339))
+                }
+                return
+            }
+            want, err := time.Parse(time.RFC3339, tt.want)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if !next.Equal(want) {
+                t.Errorf("Next(%s) = %s, want %s", tt.after, next.Format(time.RFC3339), tt.want)
+            }
+        })
+    }
+}
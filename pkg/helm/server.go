@@ -0,0 +1,127 @@
+package helm
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+    "time"
+)
+
+const defaultHTTPAddr = ":8080"
+
+// saveReport stores the result of a check in the report store, where the
+// API and metrics of every replica read it.
+func (m *Monitor) saveReport(sections []ReportSection) error {
+    if m.reportStore == nil {
+        return nil
+    }
+    return m.reportStore.Save(&StoredReport{CheckedAt: time.Now(), Sections: sections})
+}
+
+type reportResponse struct {
+    Leader    bool            `json:"leader"`
+    CheckedAt time.Time       `json:"checked_at"`
+    Sections  []ReportSection `json:"sections"`
+}
+
+// Serve runs the HTTP API on HTTP_ADDR until ctx is done:
+//
+//    /healthz      liveness
+//    /api/report   findings of the last check as JSON
+//    /metrics      Prometheus metrics
+//    /webhooks/    repository events, see handleWebhook
+func (m *Monitor) Serve(ctx context.Context) error {
+    addr := os.Getenv("HTTP_ADDR")
+    if addr == "" {
+        addr = defaultHTTPAddr
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintln(w, "ok")
+    })
+    mux.HandleFunc("/api/report", m.handleReport)
+    mux.HandleFunc("/metrics", m.handleMetrics)
+    mux.HandleFunc("/webhooks/", m.handleWebhook)
+
+    server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+    go func() {
+        <-ctx.Done()
+        shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+        defer cancel()
+        server.Shutdown(shutdownCtx)
+    }()
+
+    m.log.Infof("Serving API and metrics on %s", addr)
+    if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+        return fmt.Errorf("failed to serve HTTP: %v", err)
+    }
+    return nil
+}
+
+func (m *Monitor) loadReport() (*StoredReport, error) {
+    if m.reportStore == nil {
+        return nil, fmt.Errorf("report store is not configured")
+    }
+    return m.reportStore.Load()
+}
+
+func (m *Monitor) handleReport(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    report, err := m.loadReport()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    }
+
+    resp := reportResponse{Leader: m.IsLeader(), CheckedAt: report.CheckedAt, Sections: report.Sections}
+    if resp.Sections == nil {
+        resp.Sections = []ReportSection{}
+    }
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(resp); err != nil {
+        m.log.Debugf("Failed to write report response: %v", err)
+    }
+}
+
+func (m *Monitor) handleMetrics(w http.ResponseWriter, r *http.Request) {
+    var b strings.Builder
+    leader := 0
+    if m.IsLeader() {
+        leader = 1
+    }
+    b.WriteString("# HELP helm_monitor_leader Whether this replica runs checks and sends notifications.\n")
+    b.WriteString("# TYPE helm_monitor_leader gauge\n")
+    fmt.Fprintf(&b, "helm_monitor_leader %d\n", leader)
+
+    report, err := m.loadReport()
+    up := 1
+    if err != nil {
+        up = 0
+        m.log.Debugf("Failed to load report for metrics: %v", err)
+    }
+    b.WriteString("# HELP helm_monitor_state_up Whether the shared report could be read.\n")
+    b.WriteString("# TYPE helm_monitor_state_up gauge\n")
+    fmt.Fprintf(&b, "helm_monitor_state_up %d\n", up)
+
+    if report != nil && !report.CheckedAt.IsZero() {
+        b.WriteString("# HELP helm_monitor_last_check_timestamp_seconds Time of the last completed check.\n")
+        b.WriteString("# TYPE helm_monitor_last_check_timestamp_seconds gauge\n")
+        fmt.Fprintf(&b, "helm_monitor_last_check_timestamp_seconds %d\n", report.CheckedAt.Unix())
+
+        b.WriteString("# HELP helm_monitor_findings Findings of the last check by report section.\n")
+        b.WriteString("# TYPE helm_monitor_findings gauge\n")
+        for _, section := range report.Sections {
+            fmt.Fprintf(&b, "helm_monitor_findings{section=%q} %d\n", section.Title, len(section.Items))
+        }
+    }
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    fmt.Fprint(w, b.String())
+}
@@ -0,0 +1,270 @@
+package helm
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    defaultSlackAPIURL = "https://slack.com/api"
+
+    // Slack rejects messages with more than 50 blocks, section texts longer
+    // than 3000 characters and header texts longer than 150 characters.
+    slackMaxBlocks        = 50
+    slackMaxSectionText   = 3000
+    slackMaxHeaderText    = 150
+    slackMaxRetries       = 3
+    slackDefaultRetryWait = 30 * time.Second
+)
+
+type SlackText struct {
+    Type string `json:"type"`
+    Text string `json:"text"`
+}
+
+type SlackBlock struct {
+    Type     string      `json:"type"`
+    Text     *SlackText  `json:"text,omitempty"`
+    Elements []SlackText `json:"elements,omitempty"`
+}
+
+type slackResponse struct {
+    Ok      bool   `json:"ok"`
+    Error   string `json:"error,omitempty"`
+    Channel string `json:"channel,omitempty"`
+    TS      string `json:"ts,omitempty"`
+    User    struct {
+        ID string `json:"id"`
+    } `json:"user,omitempty"`
+}
+
+// slackChunk is one message of a report together with the findings it
+// carries, so partially delivered reports are recorded correctly.
+type slackChunk struct {
+    blocks []SlackBlock
+    keys   []string
+}
+
+// slackAPIError is returned when Slack answers with ok:false.
+type slackAPIError struct {
+    method string
+    code   string
+}
+
+func (e *slackAPIError) Error() string {
+    return fmt.Sprintf("slack API error from %s: %s", e.method, e.code)
+}
+
+func isSlackError(err error, codes ...string) bool {
+    var apiErr *slackAPIError
+    if !errors.As(err, &apiErr) {
+        return false
+    }
+    for _, code := range codes {
+        if apiErr.code == code {
+            return true
+        }
+    }
+    return false
+}
+
+type slackClient struct {
+    baseURL    string
+    token      string
+    httpClient *http.Client
+}
+
+// newSlackClient uses SLACK_API_URL when set, which allows pointing
+// helm-monitor at a local stand-in for the Slack Web API.
+func newSlackClient(token string) *slackClient {
+    baseURL := os.Getenv("SLACK_API_URL")
+    if baseURL == "" {
+        baseURL = defaultSlackAPIURL
+    }
+    return &slackClient{
+        baseURL:    strings.TrimSuffix(baseURL, "/"),
+        token:      token,
+        httpClient: &http.Client{Timeout: 30 * time.Second},
+    }
+}
+
+// call invokes a Slack Web API method with a JSON payload.
+func (c *slackClient) call(method string, payload interface{}) (*slackResponse, error) {
+    jsonPayload, err := json.Marshal(payload)
+    if err != nil {
+        return nil, fmt.Errorf("failed to marshal JSON payload: %v", err)
+    }
+    return c.send(method, "application/json; charset=utf-8", jsonPayload)
+}
+
+// callForm invokes a Slack Web API method that only accepts form arguments.
+func (c *slackClient) callForm(method string, params url.Values) (*slackResponse, error) {
+    return c.send(method, "application/x-www-form-urlencoded", []byte(params.Encode()))
+}
+
+// send posts to a Slack Web API method. Slack reports most errors with a 200
+// status and ok:false, and rate limits with 429 and a Retry-After header.
+func (c *slackClient) send(method, contentType string, body []byte) (*slackResponse, error) {
+    for attempt := 1; ; attempt++ {
+        req, err := http.NewRequest("POST", c.baseURL+"/"+method, bytes.NewBuffer(body))
+        if err != nil {
+            return nil, fmt.Errorf("failed to create request: %v", err)
+        }
+        req.Header.Set("Content-Type", contentType)
+        req.Header.Set("Authorization", "Bearer "+c.token)
+
+        resp, err := c.httpClient.Do(req)
+        if err != nil {
+            return nil, fmt.Errorf("failed to call Slack %s: %v", method, err)
+        }
+
+        if resp.StatusCode == http.StatusTooManyRequests {
+            resp.Body.Close()
+            if attempt > slackMaxRetries {
+                return nil, fmt.Errorf("failed to call Slack %s: rate limited after %d attempts", method, attempt)
+            }
+            wait := slackDefaultRetryWait
+            if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+                wait = time.Duration(seconds) * time.Second
+            }
+            time.Sleep(wait)
+            continue
+        }
+
+        var result slackResponse
+        decodeErr := json.NewDecoder(resp.Body).Decode(&result)
+        resp.Body.Close()
+
+        if resp.StatusCode != http.StatusOK {
+            return nil, fmt.Errorf("failed to call Slack %s: received status code %d", method, resp.StatusCode)
+        }
+        if decodeErr != nil {
+            return nil, fmt.Errorf("failed to decode Slack %s response: %v", method, decodeErr)
+        }
+        if !result.Ok {
+            return nil, &slackAPIError{method: method, code: result.Error}
+        }
+        return &result, nil
+    }
+}
+
+func (c *slackClient) lookupUserByEmail(email string) (string, error) {
+    resp, err := c.callForm("users.lookupByEmail", url.Values{"email": {email}})
+    if err != nil {
+        return "", err
+    }
+    return resp.User.ID, nil
+}
+
+func truncateText(text string, limit int) string {
+    runes := []rune(text)
+    if len(runes) <= limit {
+        return text
+    }
+    return string(runes[:limit-3]) + "..."
+}
+
+func headerBlock(text string) SlackBlock {
+    return SlackBlock{Type: "header", Text: &SlackText{Type: "plain_text", Text: truncateText(text, slackMaxHeaderText)}}
+}
+
+func sectionBlock(text string) SlackBlock {
+    return SlackBlock{Type: "section", Text: &SlackText{Type: "mrkdwn", Text: truncateText(text, slackMaxSectionText)}}
+}
+
+func contextBlock(text string) SlackBlock {
+    return SlackBlock{Type: "context", Elements: []SlackText{{Type: "mrkdwn", Text: text}}}
+}
+
+// renderReport turns report sections into Block Kit messages, starting a new
+// message whenever the block limit would be exceeded.
+func renderReport(sections []ReportSection, footer string) []slackChunk {
+    var chunks []slackChunk
+    current := slackChunk{}
+
+    add := func(blocks []SlackBlock, key string) {
+        if len(current.blocks)+len(blocks) > slackMaxBlocks-1 {
+            chunks = append(chunks, current)
+            current = slackChunk{}
+        }
+        current.blocks = append(current.blocks, blocks...)
+        if key != "" {
+            current.keys = append(current.keys, key)
+        }
+    }
+
+    for _, section := range sections {
+        if len(section.Items) == 0 {
+            continue
+        }
+        for i, item := range section.Items {
+            blocks := []SlackBlock{sectionBlock(strings.TrimRight(item.Text, "\n"))}
+            if i == 0 {
+                blocks = append([]SlackBlock{headerBlock(section.Title)}, blocks...)
+            }
+            add(blocks, item.Key)
+        }
+        add([]SlackBlock{{Type: "divider"}}, "")
+    }
+
+    if len(current.blocks) > 0 {
+        chunks = append(chunks, current)
+    }
+    if footer != "" && len(chunks) > 0 {
+        last := &chunks[len(chunks)-1]
+        last.blocks = append(last.blocks, contextBlock(footer))
+    }
+    return chunks
+}
+
+func countFindings(sections []ReportSection) int {
+    count := 0
+    for _, section := range sections {
+        count += len(section.Items)
+    }
+    return count
+}
+
+// renderStatus renders the full report as a single message, cutting it short
+// when it does not fit.
+func renderStatus(clusterName string, sections []ReportSection, checkedAt time.Time) []SlackBlock {
+    blocks := []SlackBlock{
+        headerBlock(fmt.Sprintf("Helm release status: %s", clusterName)),
+        contextBlock(fmt.Sprintf("[HELM-MONITOR] Last checked: UTC %s", checkedAt.UTC().Format("2006-01-02 15:04:05"))),
+    }
+
+    chunks := renderReport(sections, "")
+    if len(chunks) == 0 {
+        return append(blocks, sectionBlock(":white_check_mark: All tracked releases are up to date."))
+    }
+
+    var body []SlackBlock
+    total := 0
+    for _, chunk := range chunks {
+        body = append(body, chunk.blocks...)
+        total += len(chunk.keys)
+    }
+
+    available := slackMaxBlocks - len(blocks) - 1
+    if len(body) <= available {
+        return append(blocks, body...)
+    }
+
+    body = body[:available]
+    hidden := total
+    for _, block := range body {
+        if block.Type == "section" {
+            hidden--
+        }
+    }
+    blocks = append(blocks, body...)
+    return append(blocks, contextBlock(fmt.Sprintf("_%d more findings not shown_", hidden)))
+}
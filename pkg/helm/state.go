@@ -0,0 +1,373 @@
+package helm
+
+import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+    corev1 "k8s.io/api/core/v1"
+    apierrors "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/client-go/kubernetes"
+)
+
+const (
+    defaultStateConfigMap  = "helm-monitor-state"
+    defaultStateFile       = "/tmp/helm-monitor/state.json"
+    stateDataKey           = "state.json"
+    defaultReportConfigMap = "helm-monitor-report"
+    defaultReportFile      = "/tmp/helm-monitor/report.json.gz"
+    reportDataKey          = "report.json.gz"
+    serviceAccountNSFile   = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// State is what helm-monitor remembers between checks and restarts.
+type State struct {
+    // Announced maps finding keys, e.g. a release and the version it can be
+    // updated to, to the time they were first sent.
+    Announced        map[string]time.Time `json:"announced"`
+    LastNotification time.Time            `json:"last_notification"`
+    // HeldSince is set while findings are held back by quiet hours or a freeze
+    HeldSince time.Time `json:"held_since,omitempty"`
+
+    // StatusMessages maps channels to the timestamp of their living status
+    // message, which is edited in place on every check.
+    StatusMessages map[string]string `json:"status_messages,omitempty"`
+
+    // FailedUpgrades maps namespace/name to the chart version whose automatic
+    // upgrade failed, it is not tried again
+    FailedUpgrades map[string]string `json:"failed_upgrades,omitempty"`
+}
+
+type StateStore interface {
+    Load() (*State, error)
+    Save(state *State) error
+}
+
+// StoredReport is the result of the last check, served by every replica.
+// It is kept apart from the State, so a report too large to store cannot
+// break the deduplication of notifications.
+type StoredReport struct {
+    CheckedAt time.Time       `json:"checked_at"`
+    Sections  []ReportSection `json:"sections"`
+}
+
+type ReportStore interface {
+    Load() (*StoredReport, error)
+    Save(report *StoredReport) error
+}
+
+func newState() *State {
+    return &State{
+        Announced:      make(map[string]time.Time),
+        StatusMessages: make(map[string]string),
+    }
+}
+
+func decodeState(data []byte) (*State, error) {
+    state := newState()
+    if len(data) == 0 {
+        return state, nil
+    }
+    if err := json.Unmarshal(data, state); err != nil {
+        return nil, fmt.Errorf("failed to decode state: %v", err)
+    }
+    if state.Announced == nil {
+        state.Announced = make(map[string]time.Time)
+    }
+    if state.StatusMessages == nil {
+        state.StatusMessages = make(map[string]string)
+    }
+    return state, nil
+}
+
+// useConfigMapStore reports whether state and reports are kept in
+// ConfigMaps, which is the default when running in a cluster, or in files.
+// STATE_STORE forces either.
+func useConfigMapStore(client kubernetes.Interface, namespace string) (bool, error) {
+    switch strings.ToLower(os.Getenv("STATE_STORE")) {
+    case "configmap":
+        if namespace == "" {
+            return false, fmt.Errorf("STATE_STORE=configmap requires POD_NAMESPACE to be set")
+        }
+        return true, nil
+    case "file":
+        return false, nil
+    case "":
+        return namespace != "" && client != nil, nil
+    default:
+        return false, fmt.Errorf("invalid STATE_STORE %q, expected configmap or file", os.Getenv("STATE_STORE"))
+    }
+}
+
+// NewStateStore returns a ConfigMap-backed store when running in a cluster
+// and a file-backed one otherwise.
+func NewStateStore(client kubernetes.Interface) (StateStore, error) {
+    namespace := podNamespace()
+    configMap, err := useConfigMapStore(client, namespace)
+    if err != nil {
+        return nil, err
+    }
+    if configMap {
+        return newConfigMapStateStore(client, namespace), nil
+    }
+    return newFileStateStore(), nil
+}
+
+// NewReportStore returns a store for the report of the last check, in its
+// own ConfigMap or file next to the state.
+func NewReportStore(client kubernetes.Interface) (ReportStore, error) {
+    namespace := podNamespace()
+    configMap, err := useConfigMapStore(client, namespace)
+    if err != nil {
+        return nil, err
+    }
+    if configMap {
+        name := os.Getenv("REPORT_CONFIGMAP")
+        if name == "" {
+            name = defaultReportConfigMap
+        }
+        return &reportStore{blob: &configMapBlob{client: client, namespace: namespace, name: name, key: reportDataKey}}, nil
+    }
+    path := os.Getenv("REPORT_FILE")
+    if path == "" {
+        path = defaultReportFile
+    }
+    return &reportStore{blob: &fileBlob{path: path}}, nil
+}
+
+func podNamespace() string {
+    if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+        return ns
+    }
+    if data, err := os.ReadFile(serviceAccountNSFile); err == nil {
+        return strings.TrimSpace(string(data))
+    }
+    return ""
+}
+
+// blob is where a store keeps its encoded data.
+type blob interface {
+    // read returns nil when nothing was written yet
+    read() ([]byte, error)
+    write(data []byte) error
+}
+
+// configMapBlob is one key of a ConfigMap, created on the first write.
+// Keys ending in .gz are kept in binaryData.
+type configMapBlob struct {
+    client    kubernetes.Interface
+    namespace string
+    name      string
+    key       string
+}
+
+func (b *configMapBlob) binary() bool {
+    return strings.HasSuffix(b.key, ".gz")
+}
+
+func (b *configMapBlob) read() ([]byte, error) {
+    cm, err := b.client.CoreV1().ConfigMaps(b.namespace).Get(context.TODO(), b.name, metav1.GetOptions{})
+    if apierrors.IsNotFound(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to get ConfigMap %s/%s: %v", b.namespace, b.name, err)
+    }
+    if b.binary() {
+        return cm.BinaryData[b.key], nil
+    }
+    return []byte(cm.Data[b.key]), nil
+}
+
+func (b *configMapBlob) set(cm *corev1.ConfigMap, data []byte) {
+    if b.binary() {
+        if cm.BinaryData == nil {
+            cm.BinaryData = make(map[string][]byte)
+        }
+        cm.BinaryData[b.key] = data
+        return
+    }
+    if cm.Data == nil {
+        cm.Data = make(map[string]string)
+    }
+    cm.Data[b.key] = string(data)
+}
+
+func (b *configMapBlob) write(data []byte) error {
+    configMaps := b.client.CoreV1().ConfigMaps(b.namespace)
+    cm, err := configMaps.Get(context.TODO(), b.name, metav1.GetOptions{})
+    if apierrors.IsNotFound(err) {
+        cm = &corev1.ConfigMap{
+            ObjectMeta: metav1.ObjectMeta{
+                Name:      b.name,
+                Namespace: b.namespace,
+                Labels:    map[string]string{"app": "helm-monitor"},
+            },
+        }
+        b.set(cm, data)
+        if _, err := configMaps.Create(context.TODO(), cm, metav1.CreateOptions{}); err != nil {
+            return fmt.Errorf("failed to create ConfigMap %s/%s: %v", b.namespace, b.name, err)
+        }
+        return nil
+    }
+    if err != nil {
+        return fmt.Errorf("failed to get ConfigMap %s/%s: %v", b.namespace, b.name, err)
+    }
+
+    b.set(cm, data)
+    if _, err := configMaps.Update(context.TODO(), cm, metav1.UpdateOptions{}); err != nil {
+        return fmt.Errorf("failed to update ConfigMap %s/%s: %v", b.namespace, b.name, err)
+    }
+    return nil
+}
+
+type fileBlob struct {
+    path string
+}
+
+func (b *fileBlob) read() ([]byte, error) {
+    data, err := os.ReadFile(b.path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to read %s: %v", b.path, err)
+    }
+    return data, nil
+}
+
+func (b *fileBlob) write(data []byte) error {
+    if err := os.MkdirAll(filepath.Dir(b.path), 0o755); err != nil {
+        return fmt.Errorf("failed to create directory of %s: %v", b.path, err)
+    }
+
+    // Write to a temporary file first so a crash never leaves a truncated file
+    tmp := b.path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0o644); err != nil {
+        return fmt.Errorf("failed to write %s: %v", tmp, err)
+    }
+    if err := os.Rename(tmp, b.path); err != nil {
+        return fmt.Errorf("failed to replace %s: %v", b.path, err)
+    }
+    return nil
+}
+
+type ConfigMapStateStore struct {
+    blob *configMapBlob
+}
+
+func newConfigMapStateStore(client kubernetes.Interface, namespace string) *ConfigMapStateStore {
+    name := os.Getenv("STATE_CONFIGMAP")
+    if name == "" {
+        name = defaultStateConfigMap
+    }
+    return &ConfigMapStateStore{blob: &configMapBlob{client: client, namespace: namespace, name: name, key: stateDataKey}}
+}
+
+func (s *ConfigMapStateStore) Load() (*State, error) {
+    data, err := s.blob.read()
+    if err != nil {
+        return nil, fmt.Errorf("failed to load state: %v", err)
+    }
+    return decodeState(data)
+}
+
+func (s *ConfigMapStateStore) Save(state *State) error {
+    data, err := json.Marshal(state)
+    if err != nil {
+        return fmt.Errorf("failed to encode state: %v", err)
+    }
+    if err := s.blob.write(data); err != nil {
+        return fmt.Errorf("failed to save state: %v", err)
+    }
+    return nil
+}
+
+type FileStateStore struct {
+    blob *fileBlob
+}
+
+func newFileStateStore() *FileStateStore {
+    path := os.Getenv("STATE_FILE")
+    if path == "" {
+        path = defaultStateFile
+    }
+    return &FileStateStore{blob: &fileBlob{path: path}}
+}
+
+func (s *FileStateStore) Load() (*State, error) {
+    data, err := s.blob.read()
+    if err != nil {
+        return nil, fmt.Errorf("failed to load state: %v", err)
+    }
+    return decodeState(data)
+}
+
+func (s *FileStateStore) Save(state *State) error {
+    data, err := json.MarshalIndent(state, "", "  ")
+    if err != nil {
+        return fmt.Errorf("failed to encode state: %v", err)
+    }
+    if err := s.blob.write(data); err != nil {
+        return fmt.Errorf("failed to save state: %v", err)
+    }
+    return nil
+}
+
+// reportStore keeps the report gzip compressed, findings repeat a lot of
+// text and compress well below the 1 MiB ConfigMap limit.
+type reportStore struct {
+    blob blob
+}
+
+func (s *reportStore) Load() (*StoredReport, error) {
+    data, err := s.blob.read()
+    if err != nil {
+        return nil, fmt.Errorf("failed to load report: %v", err)
+    }
+    report := &StoredReport{}
+    if len(data) == 0 {
+        return report, nil
+    }
+
+    reader, err := gzip.NewReader(bytes.NewReader(data))
+    if err != nil {
+        return nil, fmt.Errorf("failed to decompress report: %v", err)
+    }
+    defer reader.Close()
+    decoded, err := io.ReadAll(reader)
+    if err != nil {
+        return nil, fmt.Errorf("failed to decompress report: %v", err)
+    }
+    if err := json.Unmarshal(decoded, report); err != nil {
+        return nil, fmt.Errorf("failed to decode report: %v", err)
+    }
+    return report, nil
+}
+
+func (s *reportStore) Save(report *StoredReport) error {
+    data, err := json.Marshal(report)
+    if err != nil {
+        return fmt.Errorf("failed to encode report: %v", err)
+    }
+
+    var buf bytes.Buffer
+    writer := gzip.NewWriter(&buf)
+    if _, err := writer.Write(data); err != nil {
+        return fmt.Errorf("failed to compress report: %v", err)
+    }
+    if err := writer.Close(); err != nil {
+        return fmt.Errorf("failed to compress report: %v", err)
+    }
+    if err := s.blob.write(buf.Bytes()); err != nil {
+        return fmt.Errorf("failed to save report: %v", err)
+    }
+    return nil
+}
@@ -0,0 +1,237 @@
+package helm
+
+import (
+    "fmt"
+    "reflect"
+    "sort"
+    "strings"
+    "helm.sh/helm/v3/pkg/chart"
+    "helm.sh/helm/v3/pkg/chartutil"
+)
+
+type ValuesDiff struct {
+    Added        []string
+    Removed      []string
+    Renamed      map[string]string // old key -> new key
+    RemovedInUse []string          // removed or renamed keys the release sets in its own values
+}
+
+func (d *ValuesDiff) IsEmpty() bool {
+    return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Renamed) == 0
+}
+
+// flattenValues turns nested chart values into dotted keys. Lists and empty
+// maps are treated as leaves, since helm replaces them as a whole.
+func flattenValues(values map[string]interface{}, prefix string, out map[string]interface{}) map[string]interface{} {
+    if out == nil {
+        out = make(map[string]interface{})
+    }
+
+    for key, value := range values {
+        path := key
+        if prefix != "" {
+            path = prefix + "." + key
+        }
+
+        if nested, ok := value.(map[string]interface{}); ok && len(nested) > 0 {
+            flattenValues(nested, path, out)
+            continue
+        }
+        out[path] = value
+    }
+
+    return out
+}
+
+func diffValues(installed, latest, userValues map[string]interface{}) *ValuesDiff {
+    oldKeys := flattenValues(installed, "", nil)
+    newKeys := flattenValues(latest, "", nil)
+
+    var added, removed []string
+    for key := range newKeys {
+        if _, ok := oldKeys[key]; !ok {
+            added = append(added, key)
+        }
+    }
+    for key := range oldKeys {
+        if _, ok := newKeys[key]; !ok {
+            removed = append(removed, key)
+        }
+    }
+    sort.Strings(added)
+    sort.Strings(removed)
+
+    diff := &ValuesDiff{Renamed: make(map[string]string)}
+
+    // A key is considered renamed only when it has a single added sibling
+    // with the same default value, and no other removed sibling does. Keys
+    // moved to another section, or sharing common leaf names like enabled,
+    // are reported as removed and added instead of guessing.
+    matched := make(map[string]bool)
+    for _, oldKey := range removed {
+        if !isDistinctDefault(oldKeys[oldKey]) {
+            continue
+        }
+        candidates := siblingsWithDefault(added, oldKey, oldKeys[oldKey], newKeys)
+        if len(candidates) != 1 || matched[candidates[0]] {
+            continue
+        }
+        if len(siblingsWithDefault(removed, oldKey, oldKeys[oldKey], oldKeys)) != 1 {
+            continue
+        }
+        diff.Renamed[oldKey] = candidates[0]
+        matched[candidates[0]] = true
+    }
+
+    for _, key := range added {
+        if !matched[key] {
+            diff.Added = append(diff.Added, key)
+        }
+    }
+    for _, key := range removed {
+        if _, ok := diff.Renamed[key]; !ok {
+            diff.Removed = append(diff.Removed, key)
+        }
+    }
+
+    userKeys := flattenValues(userValues, "", nil)
+    for _, key := range removed {
+        if isKeySet(userKeys, key) {
+            diff.RemovedInUse = append(diff.RemovedInUse, key)
+        }
+    }
+
+    return diff
+}
+
+func parentKey(key string) string {
+    if i := strings.LastIndex(key, "."); i >= 0 {
+        return key[:i]
+    }
+    return ""
+}
+
+// siblingsWithDefault returns the keys under the parent of key whose value
+// equals value.
+func siblingsWithDefault(keys []string, key string, value interface{}, values map[string]interface{}) []string {
+    var siblings []string
+    for _, k := range keys {
+        if parentKey(k) == parentKey(key) && reflect.DeepEqual(values[k], value) {
+            siblings = append(siblings, k)
+        }
+    }
+    return siblings
+}
+
+// isDistinctDefault reports whether a default value says enough about a key
+// to follow its rename. Empty values, zeros and booleans are shared by too
+// many keys.
+func isDistinctDefault(value interface{}) bool {
+    if value == nil {
+        return false
+    }
+    if _, ok := value.(bool); ok {
+        return false
+    }
+    v := reflect.ValueOf(value)
+    switch v.Kind() {
+    case reflect.Map, reflect.Slice, reflect.String:
+        return v.Len() > 0
+    }
+    return !v.IsZero()
+}
+
+// isKeySet reports whether the user values set the key itself, a value below
+// it, or a parent that replaces it.
+func isKeySet(userKeys map[string]interface{}, key string) bool {
+    for userKey := range userKeys {
+        if userKey == key || strings.HasPrefix(userKey, key+".") || strings.HasPrefix(key, userKey+".") {
+            return true
+        }
+    }
+    return false
+}
+
+func (d *ValuesDiff) format() string {
+    if d.IsEmpty() {
+        return ""
+    }
+
+    var renamed []string
+    for oldKey, newKey := range d.Renamed {
+        renamed = append(renamed, fmt.Sprintf("%s -> %s", oldKey, newKey))
+    }
+    sort.Strings(renamed)
+
+    msg := fmt.Sprintf("      *default values*: %d added, %d removed, %d renamed\n",
+        len(d.Added), len(d.Removed), len(d.Renamed))
+    if len(d.Added) > 0 {
+        msg += fmt.Sprintf("      *added keys*: %s\n", strings.Join(d.Added, ", "))
+    }
+    if len(d.Removed) > 0 {
+        msg += fmt.Sprintf("      *removed keys*: %s\n", strings.Join(d.Removed, ", "))
+    }
+    if len(renamed) > 0 {
+        msg += fmt.Sprintf("      *renamed keys*: %s\n", strings.Join(renamed, ", "))
+    }
+
+    if len(d.RemovedInUse) > 0 {
+        var inUse []string
+        for _, key := range d.RemovedInUse {
+            if newKey, ok := d.Renamed[key]; ok {
+                inUse = append(inUse, fmt.Sprintf("%s (now %s)", key, newKey))
+            } else {
+                inUse = append(inUse, key)
+            }
+        }
+        msg += fmt.Sprintf("      :warning: *removed keys set by release*: %s\n", strings.Join(inUse, ", "))
+    }
+
+    return msg
+}
+
+func (m *Monitor) logValuesDiff(releaseName string, d *ValuesDiff) {
+    if d.IsEmpty() {
+        m.log.Debugf("No default values changes for release %s", releaseName)
+        return
+    }
+
+    m.log.Infof("Default values changes for release %s: added %v, removed %v, renamed %v",
+        releaseName, d.Added, d.Removed, d.Renamed)
+    if len(d.RemovedInUse) > 0 {
+        m.log.Warnf("Release %s sets values removed in the latest chart: %s",
+            releaseName, strings.Join(d.RemovedInUse, ", "))
+    }
+}
+
+// validateValuesSchema validates the release's user-supplied values against the
+// values.schema.json files shipped with the chart and its subcharts, the same
+// way helm upgrade does before rendering.
+func validateValuesSchema(chrt *chart.Chart, userValues map[string]interface{}) (err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("unable to validate schema: %v", r)
+        }
+    }()
+
+    if err := chartutil.ProcessDependenciesWithMerge(chrt, userValues); err != nil {
+        return fmt.Errorf("failed to process chart dependencies: %v", err)
+    }
+
+    values, err := chartutil.CoalesceValues(chrt, userValues)
+    if err != nil {
+        return fmt.Errorf("failed to coalesce values: %v", err)
+    }
+
+    return chartutil.ValidateAgainstSchema(chrt, values)
+}
+
+func formatSchemaViolations(err error) string {
+    msg := "      :x: *upgrade will fail*: current values do not match the latest chart's values.schema.json\n"
+    for _, line := range strings.Split(strings.TrimSpace(err.Error()), "\n") {
+        if line = strings.TrimSpace(line); line != "" {
+            msg += fmt.Sprintf("        %s\n", line)
+        }
+    }
+    return msg
+}
@@ -0,0 +1,128 @@
+package helm
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestDiffValues(t *testing.T) {
+    tests := []struct {
+        name         string
+        installed    map[string]interface{}
+        latest       map[string]interface{}
+        user         map[string]interface{}
+        added        []string
+        removed      []string
+        renamed      map[string]string
+        removedInUse []string
+    }{
+        {
+            name:      "unchanged",
+            installed: map[string]interface{}{"replicas": 1, "image": map[string]interface{}{"tag": "1.0"}},
+            latest:    map[string]interface{}{"replicas": 1, "image": map[string]interface{}{"tag": "1.1"}},
+        },
+        {
+            name:      "added",
+            installed: map[string]interface{}{"replicas": 1},
+            latest:    map[string]interface{}{"replicas": 1, "metrics": map[string]interface{}{"enabled": false, "port": 9090}},
+            added:     []string{"metrics.enabled", "metrics.port"},
+        },
+        {
+            name:      "removed",
+            installed: map[string]interface{}{"replicas": 1, "legacy": map[string]interface{}{"mode": "compat"}},
+            latest:    map[string]interface{}{"replicas": 1},
+            removed:   []string{"legacy.mode"},
+        },
+        {
+            name:      "renamed sibling with the same default",
+            installed: map[string]interface{}{"image": map[string]interface{}{"repo": "nginx", "tag": "1.0"}},
+            latest:    map[string]interface{}{"image": map[string]interface{}{"repository": "nginx", "tag": "1.1"}},
+            renamed:   map[string]string{"image.repo": "image.repository"},
+        },
+        {
+            name:      "common leaf moved to another section",
+            installed: map[string]interface{}{"metrics": map[string]interface{}{"enabled": true}},
+            latest:    map[string]interface{}{"serviceMonitor": map[string]interface{}{"enabled": true}},
+            added:     []string{"serviceMonitor.enabled"},
+            removed:   []string{"metrics.enabled"},
+        },
+        {
+            name: "same leaf in several sections",
+            installed: map[string]interface{}{
+                "controller": map[string]interface{}{"image": map[string]interface{}{"tag": "1.0"}},
+            },
+            latest: map[string]interface{}{
+                "server": map[string]interface{}{"image": map[string]interface{}{"tag": "1.0"}},
+                "worker": map[string]interface{}{"image": map[string]interface{}{"tag": "1.0"}},
+            },
+            added:   []string{"server.image.tag", "worker.image.tag"},
+            removed: []string{"controller.image.tag"},
+        },
+        {
+            name:      "booleans are not followed",
+            installed: map[string]interface{}{"rbac": map[string]interface{}{"create": false}},
+            latest:    map[string]interface{}{"rbac": map[string]interface{}{"enabled": false}},
+            added:     []string{"rbac.enabled"},
+            removed:   []string{"rbac.create"},
+        },
+        {
+            name:      "ambiguous siblings",
+            installed: map[string]interface{}{"ports": map[string]interface{}{"http": 8080}},
+            latest:    map[string]interface{}{"ports": map[string]interface{}{"web": 8080, "api": 8080}},
+            added:     []string{"ports.api", "ports.web"},
+            removed:   []string{"ports.http"},
+        },
+        {
+            name:      "several removed siblings with the same default",
+            installed: map[string]interface{}{"limits": map[string]interface{}{"cpu": "1", "memory": "1"}},
+            latest:    map[string]interface{}{"limits": map[string]interface{}{"total": "1"}},
+            added:     []string{"limits.total"},
+            removed:   []string{"limits.cpu", "limits.memory"},
+        },
+        {
+            name:         "removed and renamed keys in use",
+            installed:    map[string]interface{}{"image": map[string]interface{}{"repo": "nginx"}, "legacy": map[string]interface{}{"mode": "compat"}},
+            latest:       map[string]interface{}{"image": map[string]interface{}{"repository": "nginx"}},
+            user:         map[string]interface{}{"image": map[string]interface{}{"repo": "mirror/nginx"}, "legacy": map[string]interface{}{"mode": "strict"}},
+            removed:      []string{"legacy.mode"},
+            renamed:      map[string]string{"image.repo": "image.repository"},
+            removedInUse: []string{"image.repo", "legacy.mode"},
+        },
+        {
+            name:         "parent set by the release",
+            installed:    map[string]interface{}{"legacy": map[string]interface{}{"mode": "compat", "level": 2}},
+            latest:       map[string]interface{}{},
+            user:         map[string]interface{}{"legacy": map[string]interface{}{}},
+            removed:      []string{"legacy.level", "legacy.mode"},
+            removedInUse: []string{"legacy.level", "legacy.mode"},
+        },
+        {
+            name:      "removed key not in use",
+            installed: map[string]interface{}{"legacy": map[string]interface{}{"mode": "compat"}, "replicas": 1},
+            latest:    map[string]interface{}{"replicas": 1},
+            user:      map[string]interface{}{"replicas": 3, "legacyMode": "strict"},
+            removed:   []string{"legacy.mode"},
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            diff := diffValues(tt.installed, tt.latest, tt.user)
+            if tt.renamed == nil {
+                tt.renamed = map[string]string{}
+            }
+            if !reflect.DeepEqual(diff.Added, tt.added) {
+                t.Errorf("added %v, want %v", diff.Added, tt.added)
+            }
+            if !reflect.DeepEqual(diff.Removed, tt.removed) {
+                t.Errorf("removed %v, want %v", diff.Removed, tt.removed)
+            }
+            if !reflect.DeepEqual(diff.Renamed, tt.renamed) {
+                t.Errorf("renamed %v, want %v", diff.Renamed, tt.renamed)
+            }
+            if !reflect.DeepEqual(diff.RemovedInUse, tt.removedInUse) {
+                t.Errorf("removed keys in use %v, want %v", diff.RemovedInUse, tt.removedInUse)
+            }
+        })
+    }
+}
@@ -0,0 +1,277 @@
+package helm
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+)
+
+const maxWebhookBody = 1 << 20
+
+// repoEvent is what a webhook says was published. Repositories may be names
+// or URLs; an empty chart means any chart of the repository.
+type repoEvent struct {
+    repositories []string
+    chart        string
+    version      string
+}
+
+type githubEvent struct {
+    Action     string `json:"action"`
+    Repository struct {
+        FullName string `json:"full_name"`
+        HTMLURL  string `json:"html_url"`
+    } `json:"repository"`
+    Release struct {
+        TagName string `json:"tag_name"`
+    } `json:"release"`
+    Package struct {
+        Name           string `json:"name"`
+        PackageVersion struct {
+            Version string `json:"version"`
+        } `json:"package_version"`
+    } `json:"package"`
+}
+
+type harborEvent struct {
+    Type      string `json:"type"`
+    EventData struct {
+        Repository struct {
+            Name         string `json:"name"`
+            Namespace    string `json:"namespace"`
+            RepoFullName string `json:"repo_full_name"`
+        } `json:"repository"`
+        Resources []struct {
+            Tag         string `json:"tag"`
+            ResourceURL string `json:"resource_url"`
+        } `json:"resources"`
+    } `json:"event_data"`
+}
+
+type genericEvent struct {
+    Repository string `json:"repository"`
+    Chart      string `json:"chart"`
+    Version    string `json:"version"`
+    // ChartMuseum style payloads
+    Name string `json:"name"`
+}
+
+// verifyWebhook accepts an HMAC SHA-256 of the body in X-Hub-Signature-256
+// (GitHub) or X-Signature-256, or the secret itself in the Authorization
+// header (Harbor, ChartMuseum and generic senders), optionally as a bearer
+// token.
+func verifyWebhook(r *http.Request, body []byte, secret string) bool {
+    for _, header := range []string{"X-Hub-Signature-256", "X-Signature-256"} {
+        if signature := r.Header.Get(header); signature != "" {
+            mac := hmac.New(sha256.New, []byte(secret))
+            mac.Write(body)
+            expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+            return hmac.Equal([]byte(signature), []byte(expected))
+        }
+    }
+
+    token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+func parseGitHubEvent(r *http.Request, body []byte) (*repoEvent, error) {
+    var e githubEvent
+    if err := json.Unmarshal(body, &e); err != nil {
+        return nil, fmt.Errorf("invalid GitHub payload: %v", err)
+    }
+    switch r.Header.Get("X-GitHub-Event") {
+    case "ping":
+        return nil, nil
+    case "release":
+        if e.Action != "published" && e.Action != "released" {
+            return nil, nil
+        }
+        return &repoEvent{
+            repositories: []string{e.Repository.FullName, e.Repository.HTMLURL},
+            version:      e.Release.TagName,
+        }, nil
+    case "package", "registry_package":
+        return &repoEvent{
+            repositories: []string{e.Repository.FullName, e.Repository.HTMLURL},
+            chart:        e.Package.Name,
+            version:      e.Package.PackageVersion.Version,
+        }, nil
+    default:
+        return nil, nil
+    }
+}
+
+func parseHarborEvent(body []byte) (*repoEvent, error) {
+    var e harborEvent
+    if err := json.Unmarshal(body, &e); err != nil {
+        return nil, fmt.Errorf("invalid Harbor payload: %v", err)
+    }
+    switch e.Type {
+    case "PUSH_ARTIFACT", "UPLOAD_CHART", "pushImage", "uploadChart":
+    default:
+        return nil, nil
+    }
+    event := &repoEvent{
+        repositories: []string{e.EventData.Repository.Namespace, e.EventData.Repository.RepoFullName},
+        chart:        e.EventData.Repository.Name,
+    }
+    for _, resource := range e.EventData.Resources {
+        event.version = resource.Tag
+        if resource.ResourceURL != "" {
+            event.repositories = append(event.repositories, resource.ResourceURL)
+        }
+    }
+    return event, nil
+}
+
+func parseGenericEvent(body []byte) (*repoEvent, error) {
+    var e genericEvent
+    if err := json.Unmarshal(body, &e); err != nil {
+        return nil, fmt.Errorf("invalid payload: %v", err)
+    }
+    chartName := e.Chart
+    if chartName == "" {
+        chartName = e.Name
+    }
+    if e.Repository == "" && chartName == "" {
+        return nil, fmt.Errorf("payload needs a repository or a chart")
+    }
+    return &repoEvent{repositories: []string{e.Repository}, chart: chartName, version: e.Version}, nil
+}
+
+// repositoryMatches reports whether a name or URL from a webhook refers to a
+// configured repository: by name, by URL, by a GitHub repository serving its
+// chart index on GitHub Pages, or by a Harbor project.
+func repositoryMatches(repo RepoConfig, ref string) bool {
+    ref = strings.TrimSuffix(strings.TrimSpace(ref), "/")
+    if ref == "" {
+        return false
+    }
+    if ref == repo.Name || sameRepository(ref, repo.URL) || strings.HasPrefix(ref, strings.TrimSuffix(repo.URL, "/")+"/") {
+        return true
+    }
+
+    u, err := url.Parse(repo.URL)
+    if err != nil {
+        return false
+    }
+    path := strings.Trim(u.Path, "/")
+    // owner/repo or https://github.com/owner/repo serve https://owner.github.io/repo
+    if owner, ok := strings.CutSuffix(u.Host, ".github.io"); ok {
+        fullName := owner + "/" + strings.SplitN(path, "/", 2)[0]
+        if strings.EqualFold(ref, fullName) || strings.EqualFold(ref, "https://github.com/"+fullName) {
+            return true
+        }
+    }
+    // Harbor projects serve https://harbor/chartrepo/project or oci://harbor/project
+    segments := strings.Split(path, "/")
+    project := segments[len(segments)-1]
+    if len(segments) >= 2 && segments[0] == "chartrepo" {
+        project = segments[1]
+    }
+    return project != "" && (ref == project || strings.HasPrefix(ref, project+"/"))
+}
+
+// affectedReleases maps a webhook event to the tracked releases it concerns.
+func (m *Monitor) affectedReleases(event *repoEvent) map[string]bool {
+    m.mu.Lock()
+    var matched []string
+    if m.config != nil {
+        for _, repo := range m.config.Repositories {
+            for _, ref := range event.repositories {
+                if repositoryMatches(repo, ref) {
+                    matched = append(matched, repo.URL)
+                    break
+                }
+            }
+        }
+    }
+    m.mu.Unlock()
+
+    releases := make(map[string]bool)
+    for _, repoURL := range matched {
+        for key := range m.releasesUsing(repoURL, event.chart) {
+            releases[key] = true
+        }
+    }
+    // Generic events may name only a chart
+    if len(matched) == 0 && event.chart != "" {
+        m.mu.Lock()
+        for key, tracked := range m.tracked {
+            if tracked.chart == event.chart {
+                releases[key] = true
+            }
+        }
+        m.mu.Unlock()
+    }
+    return releases
+}
+
+// handleWebhook receives repository events on /webhooks/{github,harbor,
+// chartmuseum,generic} and checks the releases they concern.
+func (m *Monitor) handleWebhook(w http.ResponseWriter, r *http.Request) {
+    secret := os.Getenv("WEBHOOK_SECRET")
+    if secret == "" {
+        http.NotFound(w, r)
+        return
+    }
+    if r.Method != http.MethodPost {
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+    if err != nil {
+        http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+        return
+    }
+    if !verifyWebhook(r, body, secret) {
+        m.log.Warnf("Rejected webhook to %s with an invalid signature", r.URL.Path)
+        http.Error(w, "invalid signature", http.StatusUnauthorized)
+        return
+    }
+
+    var event *repoEvent
+    source := strings.TrimPrefix(r.URL.Path, "/webhooks/")
+    switch source {
+    case "github":
+        event, err = parseGitHubEvent(r, body)
+    case "harbor":
+        event, err = parseHarborEvent(body)
+    case "chartmuseum", "generic":
+        event, err = parseGenericEvent(body)
+    default:
+        http.NotFound(w, r)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if event == nil {
+        w.WriteHeader(http.StatusNoContent) // not a publication
+        return
+    }
+
+    // Only the leader checks, senders should retry against it
+    if !m.IsLeader() {
+        http.Error(w, "not the leader", http.StatusServiceUnavailable)
+        return
+    }
+
+    releases := m.affectedReleases(event)
+    m.log.Infof("Received %s webhook for chart %q version %q from %s, checking %d releases",
+        source, event.chart, event.version, strings.Join(event.repositories, ", "), len(releases))
+    go m.checkReleaseSet(releases)
+
+    w.WriteHeader(http.StatusAccepted)
+    fmt.Fprintf(w, "checking %d releases\n", len(releases))
+}